@@ -1,8 +1,14 @@
 package main
 
 import (
+	"compress/gzip"
+	"compress/zlib"
+	"context"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/amwolff/google-gtfs-realtime-tools/fetch"
@@ -11,15 +17,39 @@ import (
 
 func main() { // go run -race main.go
 	p := dummy.NewDummyProvider(5 * time.Second)
+
+	h := fetch.NewWithCacheContext(
+		context.Background(),
+		p,
+		fetch.WithGzip(gzip.DefaultCompression),
+		fetch.WithDeflate(zlib.DefaultCompression))
+
+	srv := &http.Server{Addr: "localhost:8080", Handler: h}
+
+	done := make(chan struct{}) // Closed once Shutdown has returned.
 	go func() {
-		time.Sleep(10 * time.Minute)
-		log.Println("Closing DP")
-		p.Close()
+		defer close(done)
+
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+		<-c
+
+		log.Println("Shutting down")
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil { // Event streams never go idle.
+			log.Println(err)
+			srv.Close()
+		}
 	}()
 
-	h := fetch.NewWithCache(p)
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatalln(err)
+	}
+
+	<-done
 
-	if err := http.ListenAndServe("localhost:8080", h); err != nil {
+	if err := h.Close(); err != nil {
 		log.Println(err)
 	}
 }
@@ -0,0 +1,98 @@
+// Package diff implements computing DIFFERENTIAL GTFS-realtime messages
+// between FULL_DATASET ones and applying them.
+package diff
+
+import (
+	transitrealtime "github.com/amwolff/google-gtfs-realtime-tools/gen/go"
+	"github.com/golang/protobuf/proto"
+)
+
+// withIncrementality returns a copy of h (or an empty header if h is nil)
+// with the given incrementality.
+func withIncrementality(
+	h *transitrealtime.FeedHeader,
+	i transitrealtime.FeedHeader_Incrementality) *transitrealtime.FeedHeader {
+
+	ret := &transitrealtime.FeedHeader{}
+	if h != nil {
+		ret = proto.Clone(h).(*transitrealtime.FeedHeader)
+	}
+	ret.Incrementality = &i
+	return ret
+}
+
+// Diff returns DIFFERENTIAL FeedMessage that turns prev into next, both being
+// full datasets. It has the header of next and contains:
+//   - entities of next that aren't in prev or differ from their counterparts
+//     (in the order of next),
+//   - deleted entities (only ID and IsDeleted set) for entities of prev that
+//     are missing in next (in the order of prev).
+//
+// Entities are matched by ID. The returned message shares entities with next.
+func Diff(prev, next *transitrealtime.FeedMessage) *transitrealtime.FeedMessage {
+	ret := &transitrealtime.FeedMessage{
+		Header: withIncrementality(
+			next.GetHeader(),
+			transitrealtime.FeedHeader_DIFFERENTIAL),
+	}
+
+	gone := make(map[string]*transitrealtime.FeedEntity)
+	for _, e := range prev.GetEntity() {
+		gone[e.GetId()] = e
+	}
+	for _, e := range next.GetEntity() {
+		if p, ok := gone[e.GetId()]; !ok || !proto.Equal(p, e) {
+			ret.Entity = append(ret.Entity, e)
+		}
+		delete(gone, e.GetId())
+	}
+	for _, e := range prev.GetEntity() {
+		if _, ok := gone[e.GetId()]; ok {
+			ret.Entity = append(ret.Entity, &transitrealtime.FeedEntity{
+				Id:        e.Id,
+				IsDeleted: proto.Bool(true),
+			})
+		}
+	}
+	return ret
+}
+
+// Apply returns the full dataset that results from applying the DIFFERENTIAL
+// message d to the full dataset prev (which can be nil). It has the header of d
+// marked as FULL_DATASET. Entities of d replace entities of prev with the same
+// ID or are removed along with them if deleted; prev's order is kept and new
+// entities go last.
+//
+// Apply(prev, Diff(prev, next)) contains the same entities as next. The
+// returned message shares entities with prev and d.
+func Apply(prev, d *transitrealtime.FeedMessage) *transitrealtime.FeedMessage {
+	ret := &transitrealtime.FeedMessage{
+		Header: withIncrementality(
+			d.GetHeader(),
+			transitrealtime.FeedHeader_FULL_DATASET),
+	}
+
+	updates := make(map[string]*transitrealtime.FeedEntity)
+	for _, e := range d.GetEntity() {
+		updates[e.GetId()] = e
+	}
+
+	for _, e := range prev.GetEntity() {
+		u, ok := updates[e.GetId()]
+		if !ok {
+			ret.Entity = append(ret.Entity, e)
+			continue
+		}
+		delete(updates, e.GetId())
+		if !u.GetIsDeleted() {
+			ret.Entity = append(ret.Entity, u)
+		}
+	}
+	for _, e := range d.GetEntity() {
+		if _, ok := updates[e.GetId()]; ok && !e.GetIsDeleted() {
+			ret.Entity = append(ret.Entity, e)
+			delete(updates, e.GetId())
+		}
+	}
+	return ret
+}
@@ -0,0 +1,162 @@
+package diff
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+
+	transitrealtime "github.com/amwolff/google-gtfs-realtime-tools/gen/go"
+	"github.com/amwolff/google-gtfs-realtime-tools/internal/providertest"
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+)
+
+func newEntity(r *rand.Rand, id string) *transitrealtime.FeedEntity {
+	ret := &transitrealtime.FeedEntity{Id: proto.String(id)}
+	switch r.Intn(3) {
+	case 0:
+		ret.Vehicle = &transitrealtime.VehiclePosition{
+			Trip: &transitrealtime.TripDescriptor{
+				RouteId: proto.String(fmt.Sprint(r.Intn(5))),
+			},
+			Position: &transitrealtime.Position{
+				Latitude:  proto.Float32(r.Float32()),
+				Longitude: proto.Float32(r.Float32()),
+			},
+		}
+	case 1:
+		ret.TripUpdate = &transitrealtime.TripUpdate{
+			Trip: &transitrealtime.TripDescriptor{
+				TripId: proto.String(fmt.Sprint(r.Intn(5))),
+			},
+			Delay: proto.Int32(int32(r.Intn(3))),
+		}
+	default:
+		cause := transitrealtime.Alert_Cause(r.Intn(12) + 1)
+		ret.Alert = &transitrealtime.Alert{Cause: &cause}
+	}
+	return ret
+}
+
+// generateFeedMessage returns full dataset with random entities whose IDs are
+// drawn from a small pool, so that consecutive datasets overlap.
+func generateFeedMessage(r *rand.Rand, timestamp uint64) *transitrealtime.FeedMessage {
+	ret := &transitrealtime.FeedMessage{
+		Header: &transitrealtime.FeedHeader{
+			GtfsRealtimeVersion: proto.String("2.0"),
+			Timestamp:           proto.Uint64(timestamp),
+		},
+	}
+	for _, i := range r.Perm(30)[:r.Intn(30)] {
+		ret.Entity = append(ret.Entity, newEntity(r, fmt.Sprint(i)))
+	}
+	return ret
+}
+
+// mutate returns a copy of m with some entities removed, modified and added.
+func mutate(r *rand.Rand, m *transitrealtime.FeedMessage) *transitrealtime.FeedMessage {
+	ret := proto.Clone(m).(*transitrealtime.FeedMessage)
+	ret.Header.Timestamp = proto.Uint64(m.GetHeader().GetTimestamp() + 1)
+	ret.Entity = nil
+	for _, e := range m.GetEntity() {
+		switch r.Intn(4) {
+		case 0: // Removed.
+		case 1:
+			ret.Entity = append(ret.Entity, newEntity(r, e.GetId()))
+		default:
+			ret.Entity = append(ret.Entity, e)
+		}
+	}
+	for i := 0; i < r.Intn(5); i++ {
+		id := fmt.Sprintf("new-%d-%d", ret.GetHeader().GetTimestamp(), i)
+		ret.Entity = append(ret.Entity, newEntity(r, id))
+	}
+	return ret
+}
+
+// assertSameDataset asserts that a and b have equal headers (save for
+// incrementality) and the same entities, regardless of order.
+func assertSameDataset(
+	t *testing.T,
+	a, b *transitrealtime.FeedMessage,
+	msgAndArgs ...interface{}) {
+
+	ah, bh := withIncrementality(a.GetHeader(), 0), withIncrementality(b.GetHeader(), 0)
+	assert.True(t, proto.Equal(ah, bh), msgAndArgs...)
+
+	entities := make(map[string]*transitrealtime.FeedEntity)
+	for _, e := range a.GetEntity() {
+		entities[e.GetId()] = e
+	}
+	assert.Len(t, b.GetEntity(), len(entities), msgAndArgs...)
+	for _, e := range b.GetEntity() {
+		assert.True(t, proto.Equal(entities[e.GetId()], e), msgAndArgs...)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	fullDataset := transitrealtime.FeedHeader_FULL_DATASET
+	prev := &transitrealtime.FeedMessage{
+		Header: &transitrealtime.FeedHeader{
+			GtfsRealtimeVersion: proto.String("2.0"),
+			Incrementality:      &fullDataset,
+			Timestamp:           proto.Uint64(1),
+		},
+		Entity: []*transitrealtime.FeedEntity{
+			{Id: proto.String("a"), Alert: &transitrealtime.Alert{}},
+			{Id: proto.String("b"), Alert: &transitrealtime.Alert{}},
+			{Id: proto.String("c"), Alert: &transitrealtime.Alert{}},
+		},
+	}
+	next := proto.Clone(prev).(*transitrealtime.FeedMessage)
+	next.Header.Timestamp = proto.Uint64(2)
+	next.Entity = []*transitrealtime.FeedEntity{
+		{Id: proto.String("d"), Alert: &transitrealtime.Alert{}},
+		prev.Entity[1],
+		{Id: proto.String("a"), Alert: &transitrealtime.Alert{Url: &transitrealtime.TranslatedString{}}},
+	}
+
+	d := Diff(prev, next)
+	assert.Equal(t, transitrealtime.FeedHeader_DIFFERENTIAL, d.GetHeader().GetIncrementality())
+	assert.Equal(t, uint64(2), d.GetHeader().GetTimestamp())
+	assert.Equal(t, []string{"d", "a", "c"}, providertest.EntityIDs(d))
+	assert.True(t, d.Entity[2].GetIsDeleted())
+	assert.Nil(t, d.Entity[2].Alert)
+
+	assert.Empty(t, Diff(next, next).GetEntity())
+	assert.Equal(t, providertest.EntityIDs(next), providertest.EntityIDs(Diff(nil, next)))
+
+	// Neither message is modified.
+	assert.Equal(t, transitrealtime.FeedHeader_FULL_DATASET, next.GetHeader().GetIncrementality())
+	assert.Len(t, prev.GetEntity(), 3)
+
+	a := Apply(prev, d)
+	assert.Equal(t, transitrealtime.FeedHeader_FULL_DATASET, a.GetHeader().GetIncrementality())
+	assert.Equal(t, []string{"a", "b", "d"}, providertest.EntityIDs(a))
+	assertSameDataset(t, next, a)
+}
+
+func TestDiffApplyRoundTrip(t *testing.T) {
+	for seed := int64(0); seed < 200; seed++ {
+		r := rand.New(rand.NewSource(seed))
+
+		prev := generateFeedMessage(r, 1)
+		for i := 0; i < 10; i++ {
+			next := mutate(r, prev)
+			if r.Intn(5) == 0 { // Unrelated datasets.
+				next = generateFeedMessage(r, prev.GetHeader().GetTimestamp()+1)
+			}
+
+			d := Diff(prev, next)
+			assertSameDataset(t, next, Apply(prev, d), seed)
+
+			// Applying the same differential twice changes nothing.
+			assertSameDataset(t, next, Apply(Apply(prev, d), d), seed)
+
+			// There's nothing left to change.
+			assert.Empty(t, Diff(Apply(prev, d), next).GetEntity(), seed)
+
+			prev = next
+		}
+	}
+}
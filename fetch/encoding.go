@@ -0,0 +1,124 @@
+package fetch
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Supported content codings. Note that HTTP's deflate is the zlib format (RFC
+// 1950), not raw DEFLATE.
+const (
+	gzipEncoding    = "gzip"
+	deflateEncoding = "deflate"
+	identity        = "identity"
+)
+
+// contentEncodings lists supported content codings in the order of
+// preference.
+var contentEncodings = []string{gzipEncoding, deflateEncoding}
+
+var errEncodingNotAcceptable = errors.New("none of the acceptable content codings is supported")
+
+// compress returns b compressed with encoding at the given level and any error
+// encountered.
+func compress(b []byte, encoding string, level int) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	var w io.WriteCloser
+	switch encoding {
+	case gzipEncoding:
+		gw, err := gzip.NewWriterLevel(buf, level)
+		if err != nil {
+			return nil, fmt.Errorf("NewWriterLevel: %w", err)
+		}
+		w = gw
+	case deflateEncoding:
+		zw, err := zlib.NewWriterLevel(buf, level)
+		if err != nil {
+			return nil, fmt.Errorf("NewWriterLevel: %w", err)
+		}
+		w = zw
+	default:
+		return nil, fmt.Errorf("unsupported content coding: %s", encoding)
+	}
+	if _, err := w.Write(b); err != nil {
+		return nil, fmt.Errorf("Write: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("Close: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// parseAcceptEncoding returns quality factors the Accept-Encoding header
+// assigns to content codings (including "*").
+func parseAcceptEncoding(header string) map[string]float64 {
+	ret := make(map[string]float64)
+	for _, s := range strings.Split(header, ",") {
+		parts := strings.Split(s, ";")
+		coding := strings.ToLower(strings.TrimSpace(parts[0]))
+		if len(coding) == 0 {
+			continue
+		}
+		q := 1.0
+		for _, p := range parts[1:] {
+			if v := strings.TrimSpace(p); strings.HasPrefix(v, "q=") {
+				var err error
+				if q, err = strconv.ParseFloat(v[2:], 64); err != nil {
+					q = 0 // Be conservative about malformed weights.
+				}
+			}
+		}
+		ret[coding] = q
+	}
+	return ret
+}
+
+// negotiateEncoding picks the content coding for req out of the enabled ones
+// (in the order of preference). It returns an empty string for identity and
+// errEncodingNotAcceptable if the client refuses identity and every enabled
+// coding.
+//
+// Compression is preferred over identity whenever the client accepts it.
+// Codings the client doesn't list are acceptable only if it lists "*".
+// Identity is acceptable unless refused explicitly or through "*;q=0".
+func negotiateEncoding(req *http.Request, enabled []string) (string, error) {
+	header, ok := req.Header["Accept-Encoding"]
+	if !ok {
+		return "", nil // No preference.
+	}
+	qs := parseAcceptEncoding(strings.Join(header, ","))
+
+	weight := func(coding string) float64 {
+		if q, ok := qs[coding]; ok {
+			return q
+		}
+		if q, ok := qs["*"]; ok {
+			return q
+		}
+		if coding == identity {
+			return 1
+		}
+		return 0
+	}
+
+	best, bestQ := "", 0.0
+	for _, e := range enabled { // Ties go to the preferred coding.
+		if q := weight(e); q > bestQ {
+			best, bestQ = e, q
+		}
+	}
+	if bestQ > 0 {
+		return best, nil
+	}
+	if weight(identity) > 0 {
+		return "", nil
+	}
+	return "", errEncodingNotAcceptable
+}
@@ -0,0 +1,149 @@
+package fetch
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/amwolff/google-gtfs-realtime-tools/diff"
+	"github.com/amwolff/google-gtfs-realtime-tools/filter"
+	transitrealtime "github.com/amwolff/google-gtfs-realtime-tools/gen/go"
+)
+
+// Query parameters controlling how clients are notified about new messages.
+const (
+	// SinceParam turns a request into a long-poll request: WithCache responds
+	// once it has a message with header timestamp (POSIX time) greater than
+	// the parameter's value or with 304 Not Modified after the long-poll
+	// timeout (see WithLongPollTimeout).
+	SinceParam = "since"
+	// ChangesParam makes Server-Sent Events after the first one carry only
+	// entities that were added or modified since the previous event, plus
+	// deleted entities for the ones that are gone. Such messages are marked
+	// DIFFERENTIAL.
+	ChangesParam = "changes"
+)
+
+// waitNewer blocks until w has a message with header timestamp greater than
+// since or terminates. It returns false if ctx is done first.
+func (w *WithCache) waitNewer(ctx context.Context, since uint64) bool {
+	for {
+		w.mu.RLock()
+		s, closed, updated := w.recent, w.closed, w.updated
+		w.mu.RUnlock()
+
+		if closed || s != nil && s.message.GetHeader().GetTimestamp() > since {
+			return true
+		}
+
+		select {
+		case <-updated:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// acceptsEvents reports whether req asks for Server-Sent Events. Wildcards
+// don't count.
+func acceptsEvents(req *http.Request) bool {
+	for _, r := range parseAccept(req.Header.Get("Accept")) {
+		if r.typ == "text" && r.subtype == "event-stream" && r.q > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// serveEvents streams messages received from the provider as Server-Sent
+// Events until the client goes away or w terminates. A message is sent at
+// most once; clients that can't keep up only get the most recent one.
+func (w *WithCache) serveEvents(
+	rw http.ResponseWriter,
+	req *http.Request,
+	flt filter.Filter) {
+
+	flusher, ok := rw.(http.Flusher)
+	if !ok {
+		http.Error(rw, http.StatusText(ise), ise)
+		return
+	}
+
+	o, err := negotiateJSON(req, w.json)
+	if err != nil {
+		http.Error(rw, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	o.Pretty = false // Event data must fit in a single line.
+
+	var changes bool
+	if v := req.URL.Query().Get(ChangesParam); len(v) > 0 {
+		if changes, err = strconv.ParseBool(v); err != nil {
+			http.Error(rw, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Clients reconnecting with Last-Event-ID don't get what they've seen.
+	lastID, _ := strconv.ParseUint(req.Header.Get("Last-Event-ID"), 10, 64)
+
+	rw.Header().Set("Content-Type", "text/event-stream")
+	rw.Header().Set("Cache-Control", "no-cache")
+	rw.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(w.keepAlive)
+	defer keepAlive.Stop()
+
+	var (
+		sent *snapshot
+		prev *transitrealtime.FeedMessage
+	)
+	for {
+		w.mu.RLock()
+		s, closed, updated := w.recent, w.closed, w.updated
+		w.mu.RUnlock()
+
+		if s != nil && s != sent && s.message.GetHeader().GetTimestamp() > lastID {
+			m := s.message
+			if !flt.IsZero() {
+				m = flt.Apply(m)
+			}
+			out := m
+			if changes && prev != nil {
+				out = diff.Diff(prev, m)
+			}
+			b, err := MarshalJSON(out, o)
+			if err != nil { // Ending the stream is all that's left to do.
+				return
+			}
+			_, err = fmt.Fprintf(
+				rw,
+				"id: %d\ndata: %s\n\n",
+				m.GetHeader().GetTimestamp(),
+				b)
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+			sent, prev = s, m
+		}
+
+		if closed {
+			return
+		}
+
+		select {
+		case <-updated:
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(rw, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-req.Context().Done():
+			return
+		}
+	}
+}
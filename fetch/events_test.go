@@ -0,0 +1,152 @@
+package fetch
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	transitrealtime "github.com/amwolff/google-gtfs-realtime-tools/gen/go"
+	"github.com/amwolff/google-gtfs-realtime-tools/internal/providertest"
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWithCache_ServeHTTPLongPoll(t *testing.T) {
+	h := newTestWithCache(getMixedFeedMessage(100, transitrealtime.Alert_STRIKE))
+	h.longPoll = 50 * time.Millisecond
+
+	m, _ := getFeedMessage(t, h, "/?since=99")
+	assert.Equal(t, uint64(100), m.GetHeader().GetTimestamp())
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/?since=100", nil))
+	assert.Equal(t, http.StatusNotModified, rec.Code)
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/?since=yesterday", nil))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	h.longPoll = time.Minute
+
+	done := make(chan *transitrealtime.FeedMessage)
+	go func() {
+		m, _ := getFeedMessage(t, h, "/?since=100")
+		done <- m
+	}()
+	time.Sleep(10 * time.Millisecond)
+	h.store(getMixedFeedMessage(100, transitrealtime.Alert_STRIKE)) // Not newer.
+	h.store(getMixedFeedMessage(101, transitrealtime.Alert_STRIKE))
+	assert.Equal(t, uint64(101), (<-done).GetHeader().GetTimestamp())
+
+	// Long-poll requests don't wait for providers that have terminated.
+	h.terminate(nil)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/?since=101", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+}
+
+// eventReader reads Server-Sent Events.
+type eventReader struct {
+	r *bufio.Reader
+}
+
+// next returns the ID and data of the next event, skipping comments.
+func (e eventReader) next() (string, string, error) {
+	var id, data string
+	for {
+		line, err := e.r.ReadString('\n')
+		if err != nil {
+			return "", "", err
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case len(line) == 0 && len(data) > 0:
+			return id, data, nil
+		case strings.HasPrefix(line, "id: "):
+			id = line[len("id: "):]
+		case strings.HasPrefix(line, "data: "):
+			data = line[len("data: "):]
+		}
+	}
+}
+
+func (e eventReader) nextMessage() (string, *transitrealtime.FeedMessage) {
+	id, data, err := e.next()
+	if err != nil {
+		panic(fmt.Sprintf("next: %v", err))
+	}
+	var ret transitrealtime.FeedMessage
+	if err := jsonpb.Unmarshal(bytes.NewReader([]byte(data)), &ret); err != nil {
+		panic(fmt.Sprintf("Unmarshal: %v", err))
+	}
+	return id, &ret
+}
+
+func subscribe(url string, lastEventID string) (*http.Response, eventReader) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		panic(fmt.Sprintf("NewRequest: %v", err))
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	if len(lastEventID) > 0 {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		panic(fmt.Sprintf("Do: %v", err))
+	}
+	return resp, eventReader{r: bufio.NewReader(resp.Body)}
+}
+
+func TestWithCache_ServeHTTPEvents(t *testing.T) {
+	h := newWithCache()
+	h.keepAlive = 10 * time.Millisecond
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	resp, events := subscribe(srv.URL+"/?changes=true&case=snake", "")
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	first := getMixedFeedMessage(1, transitrealtime.Alert_STRIKE)
+	h.store(first)
+	id, m := events.nextMessage()
+	assert.Equal(t, "1", id)
+	assert.True(t, proto.Equal(first, m))
+
+	time.Sleep(30 * time.Millisecond) // Let some keep-alive comments through.
+
+	h.store(getMixedFeedMessage(2, transitrealtime.Alert_DEMONSTRATION))
+	id, m = events.nextMessage()
+	assert.Equal(t, "2", id)
+	assert.Equal(t, transitrealtime.FeedHeader_DIFFERENTIAL, m.GetHeader().GetIncrementality())
+	assert.Equal(t, []string{"vehicle", "trip", "alert"}, providertest.EntityIDs(m))
+
+	// Filters apply and reconnecting clients don't get what they've seen.
+	resp2, events2 := subscribe(srv.URL+"/?trip_id=t", "2")
+	defer resp2.Body.Close()
+	h.store(getMixedFeedMessage(3, transitrealtime.Alert_DEMONSTRATION))
+	id, m = events2.nextMessage()
+	assert.Equal(t, "3", id)
+	assert.Equal(t, []string{"trip", "gone"}, providertest.EntityIDs(m))
+
+	// Streams end once the provider terminates.
+	h.terminate(nil)
+	for {
+		if _, _, err := events.next(); err != nil {
+			break
+		}
+	}
+	for {
+		if _, _, err := events2.next(); err != nil {
+			break
+		}
+	}
+}
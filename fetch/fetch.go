@@ -2,63 +2,508 @@
 package fetch
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
 	"net/http"
+	"strconv"
 	"sync"
+	"time"
 
+	"github.com/amwolff/google-gtfs-realtime-tools/filter"
 	transitrealtime "github.com/amwolff/google-gtfs-realtime-tools/gen/go"
 	"github.com/amwolff/google-gtfs-realtime-tools/provider"
-	"github.com/golang/protobuf/proto"
+	"github.com/gorilla/websocket"
 )
 
-// TODO: docs?
-// TODO: make debug mode optional (this is debug mode now)
-
+// WithCache is an http.Handler that serves the most recent GTFS-realtime
+// dataset received from provider.FeedProvider.
+//
+// The dataset is served in the binary format by default. Clients can ask for
+// other formats using the Accept header or the format query parameter (which
+// takes precedence), e.g. ?format=text or ?format=json. JSON can be further
+// tailored with JSONCaseParam and JSONPrettyParam.
+//
+// Every message received from the provider is encoded only once (in every
+// supported format) and the encoded bytes are served to all clients.
+//
+// Responses carry an ETag computed from the encoded dataset and Last-Modified
+// derived from FeedHeader.Timestamp, so that polling clients can use
+// conditional requests and get 304 Not Modified if nothing has changed.
+//
+// Clients can ask for a subset of the dataset with query parameters understood
+// by filter.Parse, e.g. ?route_id=1,2&bbox=8.5,47.3,8.6,47.4. The response is
+// a valid FeedMessage containing only matching entities.
+//
+// The provider can send DIFFERENTIAL messages; WithCache applies them to the
+// dataset it holds and serves the result as FULL_DATASET. Responses carry the
+// version of the dataset in VersionHeader; clients that pass it back with
+// VersionParam get a DIFFERENTIAL message with only what has changed since.
+//
+// Clients that want to be notified about new messages can either long-poll
+// (see SinceParam) or subscribe to Server-Sent Events by asking for
+// text/event-stream. Every event carries the dataset encoded as compact JSON
+// (JSONCaseParam applies) and its header timestamp as the event ID. With
+// ?changes=true, events after the first one only carry entities that have
+// changed (see ChangesParam).
+//
+// WebSocket clients connecting to the same URL get every message as well. They
+// can narrow it down and pick the format with the query parameters above and
+// change their choice at any time by sending Subscription.
+//
+// Until the first message arrives, and when the provider has terminated,
+// WithCache responds with 503 Service Unavailable. See WithMaxAge for how
+// stale datasets are handled and Degraded for messages that can't be encoded.
 type WithCache struct {
-	closed bool
-	recent *transitrealtime.FeedMessage
-	mu     sync.RWMutex
+	compression map[string]int // Enabled content codings to compression levels.
+	retryAfter  time.Duration
+	maxAge      time.Duration
+	serveStale  bool
+	json        JSONOptions
+	history     uint64
+	epoch       string // See VersionHeader.
+	longPoll    time.Duration
+	keepAlive   time.Duration // How often idle event streams send a comment and WebSocket clients are pinged.
+	now         func() time.Time
+
+	cancel context.CancelFunc
+	done   chan struct{} // Closed once preload has returned.
+
+	closed    bool
+	streamErr error // The error returned by the provider once closed.
+	recent    *snapshot
+	received  time.Time     // When recent has been received from the provider.
+	err       error         // Non-nil if the most recent message could not be encoded.
+	updated   chan struct{} // Closed (and replaced) on every update.
+	mu        sync.RWMutex
 }
 
-func (w *WithCache) preload(provider provider.FeedProvider) {
-	feed := make(chan *transitrealtime.FeedMessage)
+// State describes whether WithCache is able to serve the dataset.
+type State int
 
-	go provider.Stream(feed)
+const (
+	// Waiting means that no message has been received from the provider yet.
+	Waiting State = iota
+	// Fresh means that the dataset is served normally.
+	Fresh
+	// Stale means that the most recent message is older than the maximum age.
+	Stale
+	// Terminated means that the provider has closed its channel and no more
+	// messages will arrive.
+	Terminated
+	// Degraded means that the most recent message could not be encoded (see
+	// Err) and the previous dataset is served instead.
+	Degraded
+)
 
-	for {
-		m, ok := <-feed
-		if !ok {
-			w.mu.Lock()
-			w.closed = true
-			w.mu.Unlock()
-			return
+func (s State) String() string {
+	switch s {
+	case Waiting:
+		return "waiting"
+	case Fresh:
+		return "fresh"
+	case Stale:
+		return "stale"
+	case Terminated:
+		return "terminated"
+	case Degraded:
+		return "degraded"
+	default:
+		return fmt.Sprintf("State(%d)", int(s))
+	}
+}
+
+// Option configures WithCache.
+type Option func(*WithCache)
+
+// WithGzip makes WithCache compress every encoded message with gzip at the
+// given level (see compress/gzip) and serve the compressed bytes to clients
+// that accept them. gzip.NoCompression disables gzip; invalid levels are
+// replaced with gzip.DefaultCompression.
+func WithGzip(level int) Option {
+	return func(w *WithCache) {
+		w.setCompression(gzipEncoding, level)
+	}
+}
+
+// WithDeflate is like WithGzip but for the deflate content coding (see
+// compress/zlib). Clients that accept both are served gzip.
+func WithDeflate(level int) Option {
+	return func(w *WithCache) {
+		w.setCompression(deflateEncoding, level)
+	}
+}
+
+func (w *WithCache) setCompression(encoding string, level int) {
+	switch {
+	case level == gzip.NoCompression:
+		delete(w.compression, encoding)
+		return
+	case level < gzip.HuffmanOnly || level > gzip.BestCompression: // Same for zlib.
+		level = gzip.DefaultCompression
+	}
+	w.compression[encoding] = level
+}
+
+// encodings returns enabled content codings in the order of preference.
+func (w *WithCache) encodings() []string {
+	var ret []string
+	for _, e := range contentEncodings {
+		if _, ok := w.compression[e]; ok {
+			ret = append(ret, e)
 		}
-		w.mu.Lock()
-		w.recent = m
-		w.mu.Unlock()
 	}
+	return ret
 }
 
-func NewWithCache(provider provider.FeedProvider) *WithCache {
-	ret := &WithCache{recent: &transitrealtime.FeedMessage{}}
+// WithRetryAfter sets the value of the Retry-After header sent along with 503
+// Service Unavailable while WithCache waits for a (fresh) message. The default
+// is 10 seconds.
+func WithRetryAfter(d time.Duration) Option {
+	return func(w *WithCache) {
+		w.retryAfter = d
+	}
+}
 
-	go ret.preload(provider)
+// WithMaxAge makes WithCache consider the dataset stale once d has passed
+// since the most recent message has been received from the provider. Stale
+// dataset is not served (503 Service Unavailable) unless WithServeStale is
+// also given. By default the dataset never goes stale.
+func WithMaxAge(d time.Duration) Option {
+	return func(w *WithCache) {
+		w.maxAge = d
+	}
+}
 
+// WithServeStale makes WithCache serve stale dataset with the Warning header
+// instead of responding with 503 Service Unavailable.
+func WithServeStale() Option {
+	return func(w *WithCache) {
+		w.serveStale = true
+	}
+}
+
+// WithJSON sets JSONOptions used for JSON responses unless the client asks for
+// different ones (see JSONCaseParam and JSONPrettyParam). Responses encoded
+// with the default options are served from cache; others are encoded per
+// request.
+func WithJSON(o JSONOptions) Option {
+	return func(w *WithCache) {
+		w.json = o
+	}
+}
+
+// WithLongPollTimeout sets how long long-poll requests (see SinceParam) wait
+// for a newer message before WithCache responds with 304 Not Modified. The
+// default is 30 seconds.
+func WithLongPollTimeout(d time.Duration) Option {
+	return func(w *WithCache) {
+		w.longPoll = d
+	}
+}
+
+// notify wakes up everyone waiting for an update. The caller must hold the
+// write lock.
+func (w *WithCache) notify() {
+	close(w.updated)
+	w.updated = make(chan struct{})
+}
+
+// WithHistory sets for how many most recent versions of the dataset WithCache
+// can serve differentials (see VersionParam). Older versions get the full
+// dataset. The default is 100.
+func WithHistory(n uint64) Option {
+	return func(w *WithCache) {
+		w.history = n
+	}
+}
+
+func (w *WithCache) store(m *transitrealtime.FeedMessage) {
+	var (
+		prev *transitrealtime.FeedMessage
+		pv   *versions
+	)
+	w.mu.RLock()
+	if w.recent != nil {
+		prev, pv = w.recent.message, w.recent.versions
+	}
+	w.mu.RUnlock()
+
+	full, vs := merge(prev, pv, m, w.history)
+
+	s, err := newSnapshot(full, w.compression, w.json)
+	if err == nil {
+		s.versions = vs
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err != nil { // Keep serving the previous dataset.
+		w.err = fmt.Errorf("newSnapshot: %w", err)
+		return
+	}
+	w.recent, w.received, w.err = s, w.now(), nil
+	w.notify()
+}
+
+// state must be called with w.mu held.
+func (w *WithCache) state() State {
+	switch {
+	case w.closed:
+		return Terminated
+	case w.recent == nil && w.err == nil:
+		return Waiting
+	case w.maxAge > 0 && w.now().Sub(w.received) > w.maxAge:
+		return Stale
+	case w.err != nil:
+		return Degraded
+	default:
+		return Fresh
+	}
+}
+
+// State returns the current State of w. It's useful for health checks.
+func (w *WithCache) State() State {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.state()
+}
+
+// touch marks the most recent message as fresh without replacing it.
+func (w *WithCache) touch() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.received = w.now()
+}
+
+// terminate marks w as no longer receiving messages because of err.
+func (w *WithCache) terminate(err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.closed, w.streamErr = true, err
+	w.notify()
+}
+
+// preload stores every message received from p until it returns and then
+// terminates w with p's error.
+func (w *WithCache) preload(ctx context.Context, p provider.ContextFeedProvider) {
+	defer close(w.done)
+	w.terminate(provider.Consume(ctx, p, w.store))
+}
+
+func newWithCache(opts ...Option) *WithCache {
+	ret := &WithCache{
+		compression: make(map[string]int),
+		retryAfter:  10 * time.Second,
+		history:     100,
+		epoch:       newEpoch(),
+		longPoll:    30 * time.Second,
+		keepAlive:   15 * time.Second,
+		now:         time.Now,
+		cancel:      func() {},
+		done:        make(chan struct{}),
+		updated:     make(chan struct{}),
+	}
+	for _, o := range opts {
+		o(ret)
+	}
 	return ret
 }
 
-const ise = http.StatusInternalServerError
+// NewWithCache returns WithCache that starts streaming from provider
+// immediately.
+func NewWithCache(p provider.FeedProvider, opts ...Option) *WithCache {
+	return NewWithCacheContext(
+		context.Background(),
+		provider.AdaptLegacy(p),
+		opts...)
+}
+
+// NewWithCacheContext is like NewWithCache but streams from
+// provider.ContextFeedProvider until ctx is done or WithCache is closed.
+func NewWithCacheContext(
+	ctx context.Context,
+	p provider.ContextFeedProvider,
+	opts ...Option) *WithCache {
 
-func (w *WithCache) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	ret := newWithCache(opts...)
+
+	ctx, ret.cancel = context.WithCancel(ctx)
+
+	go ret.preload(ctx, p)
+
+	return ret
+}
+
+// Shutdown stops streaming from the provider and waits until the provider has
+// returned or ctx is done, whichever happens first. In the latter case it
+// returns ctx.Err().
+//
+// WithCache responds with 503 Service Unavailable after Shutdown. Use
+// http.Server's Shutdown first to drain in-flight requests.
+//
+// Note that provider.FeedProvider adapted with provider.AdaptLegacy cannot be
+// stopped and will keep running in the background.
+func (w *WithCache) Shutdown(ctx context.Context) error {
+	w.cancel()
+	select {
+	case <-w.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close is like Shutdown but waits for the provider indefinitely.
+func (w *WithCache) Close() error {
+	return w.Shutdown(context.Background())
+}
+
+// Err returns the error that has terminated streaming from the provider. While
+// streaming, it returns the error encoding the most recent message if it could
+// not be encoded (the previous dataset is served then) and nil otherwise. It
+// also returns nil if the provider has finished without an error.
+func (w *WithCache) Err() error {
 	w.mu.RLock()
+	defer w.mu.RUnlock()
 	if w.closed {
-		http.Error(rw, http.StatusText(http.StatusTeapot), http.StatusTeapot)
-		w.mu.RUnlock()
+		return w.streamErr
+	}
+	return w.err
+}
+
+const (
+	ise = http.StatusInternalServerError
+	sue = http.StatusServiceUnavailable
+)
+
+func (w *WithCache) unavailable(rw http.ResponseWriter, retry bool) {
+	if retry {
+		secs := int(w.retryAfter.Round(time.Second) / time.Second)
+		rw.Header().Set("Retry-After", strconv.Itoa(secs))
+	}
+	http.Error(rw, http.StatusText(sue), sue)
+}
+
+func (w *WithCache) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	encodings := w.encodings()
+
+	rw.Header().Add("Vary", "Accept")
+	if len(encodings) > 0 {
+		rw.Header().Add("Vary", "Accept-Encoding")
+	}
+
+	if websocket.IsWebSocketUpgrade(req) {
+		w.serveWebSocket(rw, req)
+		return
+	}
+
+	flt, err := filter.Parse(req.URL.Query())
+	if err != nil {
+		http.Error(rw, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 		return
 	}
-	m := proto.Clone(w.recent)
+
+	known, err := parseVersion(req.URL.Query())
+	if err != nil {
+		http.Error(rw, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	if acceptsEvents(req) {
+		w.serveEvents(rw, req, flt)
+		return
+	}
+
+	f, err := negotiateFormat(req)
+	if err != nil {
+		code := http.StatusBadRequest
+		if errors.Is(err, errNotAcceptable) {
+			code = http.StatusNotAcceptable
+		}
+		http.Error(rw, http.StatusText(code), code)
+		return
+	}
+
+	v := variant{format: f}
+	if f == JSON {
+		if v.json, err = negotiateJSON(req, w.json); err != nil {
+			http.Error(rw, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+	}
+	if v.encoding, err = negotiateEncoding(req, encodings); err != nil {
+		http.Error(rw, http.StatusText(http.StatusNotAcceptable), http.StatusNotAcceptable)
+		return
+	}
+
+	if since := req.URL.Query().Get(SinceParam); len(since) > 0 {
+		var timestamp uint64
+		if timestamp, err = strconv.ParseUint(since, 10, 64); err != nil {
+			http.Error(rw, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		ctx, cancel := context.WithTimeout(req.Context(), w.longPoll)
+		defer cancel()
+		if !w.waitNewer(ctx, timestamp) {
+			rw.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+
+	w.mu.RLock()
+	s, state := w.recent, w.state()
 	w.mu.RUnlock()
 
-	if err := proto.MarshalText(rw, m); err != nil {
+	switch state {
+	case Waiting:
+		w.unavailable(rw, true)
+		return
+	case Terminated:
+		w.unavailable(rw, false)
+		return
+	case Stale:
+		if !w.serveStale {
+			w.unavailable(rw, true)
+			return
+		}
+		rw.Header().Set("Warning", `110 - "Response is Stale"`)
+	case Degraded:
+		rw.Header().Set("Warning", `110 - "Response is Stale"`)
+	}
+
+	if s == nil { // Not even the first message could be encoded.
 		http.Error(rw, http.StatusText(ise), ise)
+		return
+	}
+
+	m, diff := s.message, false
+	if known.n > 0 && known.epoch == w.epoch { // Otherwise it's from before a restart.
+		m, diff = differential(s.message, s.versions, known.n)
+		if !diff {
+			m = s.message
+		}
+	}
+	rw.Header().Set(VersionHeader, version{w.epoch, s.versions.current}.String())
+
+	bd, ok := s.bodies[v]
+	if !ok || diff || !flt.IsZero() { // Not encoded in advance.
+		if bd, err = newBody(flt.Apply(m), v, w.compression); err != nil {
+			http.Error(rw, http.StatusText(ise), ise)
+			return
+		}
+	}
+
+	if len(v.encoding) > 0 {
+		rw.Header().Set("Content-Encoding", v.encoding)
 	}
+	rw.Header().Set("Content-Type", f.ContentType())
+	rw.Header().Set("ETag", bd.etag)
+
+	// ServeContent takes care of conditional requests (If-None-Match,
+	// If-Modified-Since, ...) and sets Last-Modified if it's known.
+	http.ServeContent(rw, req, "", s.lastModified, bytes.NewReader(bd.b))
 }
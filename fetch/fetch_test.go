@@ -0,0 +1,633 @@
+package fetch
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	transitrealtime "github.com/amwolff/google-gtfs-realtime-tools/gen/go"
+	"github.com/amwolff/google-gtfs-realtime-tools/internal/providertest"
+	"github.com/amwolff/google-gtfs-realtime-tools/provider"
+	"github.com/amwolff/google-gtfs-realtime-tools/provider/dummy"
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+)
+
+func mustLoadTestFeedMessage() *transitrealtime.FeedMessage {
+	b, err := ioutil.ReadFile(filepath.Clean("./testdata/trip-updates-full.asciipb"))
+	if err != nil {
+		panic(fmt.Sprintf("ReadFile: %v", err))
+	}
+	var ret transitrealtime.FeedMessage
+	if err := proto.UnmarshalText(string(b), &ret); err != nil {
+		panic(fmt.Sprintf("UnmarshalText: %v", err))
+	}
+	return &ret
+}
+
+func newTestWithCache(
+	m *transitrealtime.FeedMessage,
+	opts ...Option) *WithCache {
+
+	ret := newWithCache(opts...)
+	ret.store(m)
+	return ret
+}
+
+// generateFeedMessage returns FeedMessage with n vehicle positions.
+func generateFeedMessage(n int) *transitrealtime.FeedMessage {
+	fullDataset := transitrealtime.FeedHeader_FULL_DATASET
+	ret := &transitrealtime.FeedMessage{
+		Header: &transitrealtime.FeedHeader{
+			GtfsRealtimeVersion: proto.String("2.0"),
+			Incrementality:      &fullDataset,
+			Timestamp:           proto.Uint64(1583020800),
+		},
+	}
+	for i := 0; i < n; i++ {
+		ret.Entity = append(ret.Entity, &transitrealtime.FeedEntity{
+			Id: proto.String(fmt.Sprintf("vehicle-position-%d", i)),
+			Vehicle: &transitrealtime.VehiclePosition{
+				Trip: &transitrealtime.TripDescriptor{
+					TripId:  proto.String(fmt.Sprintf("trip-%d", i)),
+					RouteId: proto.String(fmt.Sprintf("route-%d", i%50)),
+				},
+				Vehicle: &transitrealtime.VehicleDescriptor{
+					Id:    proto.String(fmt.Sprintf("vehicle-%d", i)),
+					Label: proto.String(fmt.Sprint(i)),
+				},
+				Position: &transitrealtime.Position{
+					Latitude:  proto.Float32(47.37 + float32(i%100)/1000),
+					Longitude: proto.Float32(8.54 + float32(i/100)/1000),
+				},
+				StopId:    proto.String(fmt.Sprintf("stop-%d", i%300)),
+				Timestamp: proto.Uint64(1583020800 - uint64(i%30)),
+			},
+		})
+	}
+	return ret
+}
+
+func TestNegotiateFormat(t *testing.T) {
+	for i, tt := range []struct {
+		query, accept string
+		expected      Format
+		err           error
+	}{
+		{expected: Binary},
+		{accept: "*/*", expected: Binary},
+		{accept: "application/x-protobuf", expected: Binary},
+		{accept: "application/octet-stream", expected: Binary},
+		{accept: "text/plain", expected: Text},
+		{accept: "text/*", expected: Text},
+		{accept: "application/json", expected: JSON},
+		{accept: "application/json, text/plain;q=0.5", expected: JSON},
+		{accept: "application/json;q=0.1, */*;q=0.5", expected: Binary},
+		{accept: "text/html,application/xhtml+xml,*/*;q=0.8", expected: Binary},
+		{accept: "image/png", err: errNotAcceptable},
+		{accept: "application/x-protobuf;q=0", err: errNotAcceptable},
+		{query: "format=json", accept: "text/plain", expected: JSON},
+		{query: "format=text", expected: Text},
+		{query: "format=pb", expected: Binary},
+		{query: "format=xml", err: errUnknownFormat},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/?"+tt.query, nil)
+		if len(tt.accept) > 0 {
+			req.Header.Set("Accept", tt.accept)
+		}
+		f, err := negotiateFormat(req)
+		if tt.err != nil {
+			assert.Equal(t, tt.err, err, i)
+			continue
+		}
+		assert.NoError(t, err, i)
+		assert.Equal(t, tt.expected, f, i)
+	}
+}
+
+func TestWithCache_ServeHTTP(t *testing.T) {
+	m := mustLoadTestFeedMessage()
+	h := newTestWithCache(m)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/x-protobuf", rec.Header().Get("Content-Type"))
+	var binary transitrealtime.FeedMessage
+	assert.NoError(t, proto.Unmarshal(rec.Body.Bytes(), &binary))
+	assert.True(t, proto.Equal(m, &binary))
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/?format=text", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "text/plain; charset=utf-8", rec.Header().Get("Content-Type"))
+	var text transitrealtime.FeedMessage
+	assert.NoError(t, proto.UnmarshalText(rec.Body.String(), &text))
+	assert.True(t, proto.Equal(m, &text))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept", "application/json")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	var json transitrealtime.FeedMessage
+	assert.NoError(t, jsonpb.Unmarshal(rec.Body, &json))
+	assert.True(t, proto.Equal(m, &json))
+
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept", "image/png")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusNotAcceptable, rec.Code)
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/?format=xml", nil))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestWithCache_ServeHTTPUnencodable(t *testing.T) {
+	m := mustLoadTestFeedMessage()
+	h := newTestWithCache(m)
+
+	h.store(&transitrealtime.FeedMessage{}) // Header is required.
+	assert.Error(t, h.Err())
+	assert.Equal(t, Degraded, h.State())
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, `110 - "Response is Stale"`, rec.Header().Get("Warning"))
+	var served transitrealtime.FeedMessage
+	assert.NoError(t, proto.Unmarshal(rec.Body.Bytes(), &served))
+	assert.True(t, proto.Equal(m, &served))
+
+	h.store(m)
+	assert.NoError(t, h.Err())
+	assert.Equal(t, Fresh, h.State())
+}
+
+func TestNegotiateJSON(t *testing.T) {
+	for i, tt := range []struct {
+		query, accept string
+		def, expected JSONOptions
+		err           error
+	}{
+		{},
+		{def: JSONOptions{SnakeCase: true}, expected: JSONOptions{SnakeCase: true}},
+		{query: "case=snake&pretty=1", expected: JSONOptions{SnakeCase: true, Pretty: true}},
+		{query: "case=camel", def: JSONOptions{SnakeCase: true}},
+		{accept: "application/json; case=snake", expected: JSONOptions{SnakeCase: true}},
+		{accept: "application/json; pretty=true; q=0.5", expected: JSONOptions{Pretty: true}},
+		{query: "pretty=false", accept: "application/json; pretty=true"},
+		{accept: "text/plain; case=snake"},
+		{query: "case=kebab", err: errInvalidJSONOptions},
+		{query: "pretty=very", err: errInvalidJSONOptions},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/?"+tt.query, nil)
+		if len(tt.accept) > 0 {
+			req.Header.Set("Accept", tt.accept)
+		}
+		o, err := negotiateJSON(req, tt.def)
+		if tt.err != nil {
+			assert.Equal(t, tt.err, err, i)
+			continue
+		}
+		assert.NoError(t, err, i)
+		assert.Equal(t, tt.expected, o, i)
+	}
+}
+
+func TestWithCache_ServeHTTPJSON(t *testing.T) {
+	m := mustLoadTestFeedMessage()
+	h := newTestWithCache(m, WithJSON(JSONOptions{SnakeCase: true}))
+
+	get := func(query string) string {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/?format=json&"+query, nil))
+		assert.Equal(t, http.StatusOK, rec.Code, query)
+		assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+		var actual transitrealtime.FeedMessage
+		assert.NoError(t, jsonpb.Unmarshal(bytes.NewReader(rec.Body.Bytes()), &actual))
+		assert.True(t, proto.Equal(m, &actual), query)
+		return rec.Body.String()
+	}
+
+	b := get("")
+	assert.Contains(t, b, `"gtfs_realtime_version":"2.0"`)
+	assert.Contains(t, b, `"incrementality":"FULL_DATASET"`)
+
+	b = get("case=camel&pretty=true")
+	assert.Contains(t, b, `"gtfsRealtimeVersion": "2.0"`)
+	assert.Contains(t, b, "\n  \"header\": {")
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/?format=json&case=kebab", nil))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestWithCache_ServeHTTPGzip(t *testing.T) {
+	m := mustLoadTestFeedMessage()
+	h := newTestWithCache(m, WithGzip(gzip.BestCompression))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept-Encoding", "deflate, gzip")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "gzip", rec.Header().Get("Content-Encoding"))
+	assert.Contains(t, rec.Header()["Vary"], "Accept-Encoding")
+
+	r, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		panic(fmt.Sprintf("NewReader: %v", err))
+	}
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		panic(fmt.Sprintf("ReadAll: %v", err))
+	}
+	var actual transitrealtime.FeedMessage
+	assert.NoError(t, proto.Unmarshal(b, &actual))
+	assert.True(t, proto.Equal(m, &actual))
+
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip;q=0")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	assert.Empty(t, rec.Header().Get("Content-Encoding"))
+	expected, err := proto.Marshal(m)
+	if err != nil {
+		panic(fmt.Sprintf("Marshal: %v", err))
+	}
+	assert.True(t, bytes.Equal(expected, rec.Body.Bytes()))
+}
+
+func TestNegotiateEncoding(t *testing.T) {
+	both := []string{gzipEncoding, deflateEncoding}
+	for i, tt := range []struct {
+		header   []string
+		enabled  []string
+		expected string
+		err      error
+	}{
+		{enabled: both},
+		{header: []string{""}, enabled: both},
+		{header: []string{"gzip"}},
+		{header: []string{"gzip, deflate"}, enabled: both, expected: gzipEncoding},
+		{header: []string{"deflate, gzip"}, enabled: both, expected: gzipEncoding},
+		{header: []string{"gzip;q=0.5, deflate"}, enabled: both, expected: deflateEncoding},
+		{header: []string{"deflate"}, enabled: []string{gzipEncoding}},
+		{header: []string{"GZIP"}, enabled: both, expected: gzipEncoding},
+		{header: []string{"*"}, enabled: both, expected: gzipEncoding},
+		{header: []string{"br, *;q=0.1"}, enabled: []string{deflateEncoding}, expected: deflateEncoding},
+		{header: []string{"gzip;q=0, *"}, enabled: both, expected: deflateEncoding},
+		{header: []string{"br", "deflate"}, enabled: both, expected: deflateEncoding},
+		{header: []string{"identity"}, enabled: both},
+		{header: []string{"gzip;q=0, identity;q=0.5"}, enabled: both},
+		{header: []string{"identity;q=0"}, enabled: both, err: errEncodingNotAcceptable},
+		{header: []string{"br, *;q=0"}, enabled: both, err: errEncodingNotAcceptable},
+		{header: []string{"gzip, identity;q=0"}, enabled: both, expected: gzipEncoding},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if tt.header != nil {
+			req.Header["Accept-Encoding"] = tt.header
+		}
+		e, err := negotiateEncoding(req, tt.enabled)
+		if tt.err != nil {
+			assert.Equal(t, tt.err, err, i)
+			continue
+		}
+		assert.NoError(t, err, i)
+		assert.Equal(t, tt.expected, e, i)
+	}
+}
+
+func TestWithCache_ServeHTTPDeflate(t *testing.T) {
+	m := mustLoadTestFeedMessage()
+	h := newTestWithCache(m, WithGzip(gzip.DefaultCompression), WithDeflate(zlib.BestSpeed))
+
+	req := httptest.NewRequest(http.MethodGet, "/?format=text", nil)
+	req.Header.Set("Accept-Encoding", "gzip;q=0.8, deflate")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "deflate", rec.Header().Get("Content-Encoding"))
+
+	r, err := zlib.NewReader(rec.Body)
+	if err != nil {
+		panic(fmt.Sprintf("NewReader: %v", err))
+	}
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		panic(fmt.Sprintf("ReadAll: %v", err))
+	}
+	var actual transitrealtime.FeedMessage
+	assert.NoError(t, proto.UnmarshalText(string(b), &actual))
+	assert.True(t, proto.Equal(m, &actual))
+
+	// Every variant is compressed once, in advance.
+	assert.Len(t, h.recent.bodies, len(formats)*3)
+
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept-Encoding", "br, identity;q=0")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusNotAcceptable, rec.Code)
+}
+
+func TestWithCache_ServeHTTPInvalidCompressionLevel(t *testing.T) {
+	h := newTestWithCache(mustLoadTestFeedMessage(), WithGzip(42), WithDeflate(-3))
+	assert.Equal(t, map[string]int{
+		"gzip":    gzip.DefaultCompression,
+		"deflate": gzip.DefaultCompression,
+	}, h.compression)
+
+	for _, encoding := range []string{"gzip", "deflate"} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Accept-Encoding", encoding)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusOK, rec.Code, encoding)
+		assert.Equal(t, encoding, rec.Header().Get("Content-Encoding"))
+	}
+}
+
+// discardResponseWriter is http.ResponseWriter that throws away everything
+// written to it.
+type discardResponseWriter struct {
+	h http.Header
+}
+
+func (d *discardResponseWriter) Header() http.Header         { return d.h }
+func (d *discardResponseWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (d *discardResponseWriter) WriteHeader(int)             {}
+
+func benchmarkWithCacheServeHTTP(b *testing.B, acceptEncoding string) {
+	h := newTestWithCache(generateFeedMessage(2000), WithGzip(gzip.DefaultCompression))
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		for pb.Next() {
+			h.ServeHTTP(&discardResponseWriter{h: make(http.Header)}, req)
+		}
+	})
+}
+
+func BenchmarkWithCache_ServeHTTP(b *testing.B) {
+	benchmarkWithCacheServeHTTP(b, "")
+}
+
+func BenchmarkWithCache_ServeHTTPGzip(b *testing.B) {
+	benchmarkWithCacheServeHTTP(b, "gzip")
+}
+
+// BenchmarkMarshalPerRequest approximates the cost of encoding the dataset
+// on every request for comparison with BenchmarkWithCache_ServeHTTP.
+func BenchmarkMarshalPerRequest(b *testing.B) {
+	m := generateFeedMessage(2000)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			c := proto.Clone(m).(*transitrealtime.FeedMessage)
+			if _, err := Binary.marshal(c); err != nil {
+				panic(fmt.Sprintf("marshal: %v", err))
+			}
+		}
+	})
+}
+
+func TestWithCache_ServeHTTPConditional(t *testing.T) {
+	m := mustLoadTestFeedMessage()
+	h := newTestWithCache(m, WithGzip(gzip.DefaultCompression))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	etag := rec.Header().Get("ETag")
+	assert.NotEmpty(t, etag)
+	assert.Equal(t, "Tue, 14 Sep 2010 09:44:28 GMT", rec.Header().Get("Last-Modified"))
+
+	// Every representation has its own entity tag.
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/?format=json", nil))
+	assert.NotEqual(t, etag, rec.Header().Get("ETag"))
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	assert.NotEqual(t, etag, rec.Header().Get("ETag"))
+
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("If-None-Match", etag)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusNotModified, rec.Code)
+	assert.Empty(t, rec.Body.Bytes())
+
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("If-Modified-Since", "Tue, 14 Sep 2010 09:44:28 GMT")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusNotModified, rec.Code)
+
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("If-Modified-Since", "Tue, 14 Sep 2010 09:44:27 GMT")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	// A new dataset invalidates the old entity tag.
+	updated := proto.Clone(m).(*transitrealtime.FeedMessage)
+	updated.Header.Timestamp = proto.Uint64(m.GetHeader().GetTimestamp() + 30)
+	h.store(updated)
+
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("If-None-Match", etag)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.NotEqual(t, etag, rec.Header().Get("ETag"))
+}
+
+func TestWithCache_ServeHTTPFilter(t *testing.T) {
+	h := newTestWithCache(generateFeedMessage(200), WithGzip(gzip.DefaultCompression))
+
+	m, etag := getFeedMessage(t, h, "/?route_id=route-1,route-2&stop_id=stop-1")
+	assert.Equal(t, []string{"vehicle-position-1"}, providertest.EntityIDs(m))
+	assert.Equal(t, "2.0", m.GetHeader().GetGtfsRealtimeVersion())
+
+	m, _ = getFeedMessage(t, h, "/?vehicle_id=vehicle-0&vehicle_id=vehicle-150")
+	assert.Equal(t, []string{"vehicle-position-0", "vehicle-position-150"}, providertest.EntityIDs(m))
+
+	m, _ = getFeedMessage(t, h, "/?bbox=8.5405,47.3,8.6,47.371")
+	assert.Equal(t, []string{"vehicle-position-100", "vehicle-position-101"}, providertest.EntityIDs(m))
+
+	m, _ = getFeedMessage(t, h, "/?trip_id=nonexistent")
+	assert.Empty(t, m.GetEntity())
+
+	// Filtered responses can be compressed and validated too.
+	req := httptest.NewRequest(http.MethodGet, "/?route_id=route-1,route-2&stop_id=stop-1", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "gzip", rec.Header().Get("Content-Encoding"))
+
+	req = httptest.NewRequest(http.MethodGet, "/?route_id=route-1,route-2&stop_id=stop-1", nil)
+	req.Header.Set("If-None-Match", etag)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusNotModified, rec.Code)
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/?bbox=1,2,3", nil))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestWithCache_ServeHTTPStates(t *testing.T) {
+	now := time.Date(2020, time.March, 1, 12, 0, 0, 0, time.UTC)
+
+	h := newWithCache(WithRetryAfter(15*time.Second), WithMaxAge(time.Minute))
+	h.now = func() time.Time { return now }
+
+	assert.Equal(t, Waiting, h.State())
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Equal(t, "15", rec.Header().Get("Retry-After"))
+
+	h.store(mustLoadTestFeedMessage())
+
+	assert.Equal(t, Fresh, h.State())
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	now = now.Add(2 * time.Minute)
+
+	assert.Equal(t, Stale, h.State())
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Equal(t, "15", rec.Header().Get("Retry-After"))
+
+	WithServeStale()(h)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, `110 - "Response is Stale"`, rec.Header().Get("Warning"))
+
+	h.mu.Lock()
+	h.closed = true
+	h.mu.Unlock()
+
+	assert.Equal(t, Terminated, h.State())
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Empty(t, rec.Header().Get("Retry-After"))
+}
+
+func waitForState(w *WithCache, s State) {
+	for w.State() != s {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestNewWithCacheContext(t *testing.T) {
+	m := mustLoadTestFeedMessage()
+	errTerminal := errors.New("database is gone")
+
+	h := NewWithCacheContext(
+		context.Background(),
+		providertest.Slice{
+			Messages: []*transitrealtime.FeedMessage{m},
+			Err:      errTerminal,
+		})
+	waitForState(h, Terminated)
+	assert.Equal(t, errTerminal, h.Err())
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	h = NewWithCacheContext(ctx, provider.AdaptLegacy(dummy.NewDummyProvider(time.Hour)))
+	waitForState(h, Fresh)
+	assert.NoError(t, h.Err())
+	cancel()
+	waitForState(h, Terminated)
+	assert.Equal(t, context.Canceled, h.Err())
+}
+
+// checkGoroutines asserts that the number of goroutines drops back to n, i.e.
+// that nothing has been left running in the background.
+func checkGoroutines(t *testing.T, n int) {
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > n && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.LessOrEqual(t, runtime.NumGoroutine(), n)
+}
+
+func TestWithCache_Close(t *testing.T) {
+	n := runtime.NumGoroutine()
+
+	h := NewWithCacheContext(context.Background(), dummy.NewDummyProvider(time.Hour))
+	waitForState(h, Fresh)
+
+	assert.NoError(t, h.Close())
+	assert.Equal(t, Terminated, h.State())
+	assert.Equal(t, context.Canceled, h.Err())
+	assert.NoError(t, h.Close()) // Close is idempotent.
+
+	checkGoroutines(t, n)
+}
+
+// stubbornProvider ignores cancellation until released.
+type stubbornProvider struct {
+	release chan struct{}
+}
+
+func (s stubbornProvider) StreamContext(
+	ctx context.Context,
+	feed chan<- *transitrealtime.FeedMessage) error {
+
+	defer close(feed)
+	<-s.release
+	return ctx.Err()
+}
+
+func TestWithCache_Shutdown(t *testing.T) {
+	n := runtime.NumGoroutine()
+
+	p := stubbornProvider{release: make(chan struct{})}
+	h := NewWithCacheContext(context.Background(), p)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, h.Shutdown(ctx))
+	assert.Equal(t, Waiting, h.State())
+
+	close(p.release)
+	assert.NoError(t, h.Shutdown(context.Background()))
+	assert.Equal(t, Terminated, h.State())
+
+	checkGoroutines(t, n)
+}
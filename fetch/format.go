@@ -0,0 +1,204 @@
+package fetch
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	transitrealtime "github.com/amwolff/google-gtfs-realtime-tools/gen/go"
+	"github.com/golang/protobuf/proto"
+)
+
+// Format is a representation in which GTFS-realtime dataset can be served.
+type Format int
+
+const (
+	// Binary is the protocol buffers wire format. This is the format that
+	// Google and virtually every GTFS-realtime consumer expects.
+	Binary Format = iota
+	// Text is the protocol buffers text format. It is meant for debugging.
+	Text
+	// JSON is the protocol buffers JSON mapping of the dataset.
+	JSON
+)
+
+// formats lists supported formats in the order of preference.
+var formats = []Format{Binary, Text, JSON}
+
+func (f Format) String() string {
+	switch f {
+	case Binary:
+		return "binary"
+	case Text:
+		return "text"
+	case JSON:
+		return "json"
+	default:
+		return fmt.Sprintf("Format(%d)", int(f))
+	}
+}
+
+// ContentType returns the value of the Content-Type header for f.
+func (f Format) ContentType() string {
+	switch f {
+	case Text:
+		return "text/plain; charset=utf-8"
+	case JSON:
+		return "application/json"
+	default:
+		return "application/x-protobuf"
+	}
+}
+
+func (f Format) marshal(m *transitrealtime.FeedMessage) ([]byte, error) {
+	switch f {
+	case Binary:
+		b, err := proto.Marshal(m)
+		if err != nil {
+			return nil, fmt.Errorf("Marshal: %w", err)
+		}
+		return b, nil
+	case Text:
+		b := &bytes.Buffer{}
+		if err := proto.MarshalText(b, m); err != nil {
+			return nil, fmt.Errorf("MarshalText: %w", err)
+		}
+		return b.Bytes(), nil
+	case JSON:
+		b, err := MarshalJSON(m, JSONOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("MarshalJSON: %w", err)
+		}
+		return b, nil
+	default:
+		return nil, fmt.Errorf("unsupported format: %v", f)
+	}
+}
+
+var (
+	errUnknownFormat = errors.New("unknown format")
+	errNotAcceptable = errors.New("none of the acceptable media types is supported")
+)
+
+// ParseFormat returns Format named by s (as in the format query parameter) and
+// any error encountered.
+func ParseFormat(s string) (Format, error) {
+	switch strings.ToLower(s) {
+	case "binary", "pb", "proto", "protobuf":
+		return Binary, nil
+	case "text", "txt", "asciipb":
+		return Text, nil
+	case "json":
+		return JSON, nil
+	default:
+		return 0, errUnknownFormat
+	}
+}
+
+// mediaTypes maps media types that clients may ask for onto formats.
+var mediaTypes = map[string]Format{
+	"application/x-protobuf":          Binary,
+	"application/protobuf":            Binary,
+	"application/x-google-protobuf":   Binary,
+	"application/vnd.google.protobuf": Binary,
+	"application/octet-stream":        Binary,
+	"text/plain":                      Text,
+	"application/json":                JSON,
+}
+
+type acceptRange struct {
+	typ, subtype string
+	q            float64
+	params       map[string]string // Other than q.
+}
+
+func parseAccept(header string) []acceptRange {
+	var ret []acceptRange
+	for _, s := range strings.Split(header, ",") {
+		if len(strings.TrimSpace(s)) == 0 {
+			continue
+		}
+		mediaType, params, err := mime.ParseMediaType(s)
+		if err != nil {
+			continue // Be lenient; ignore malformed ranges.
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+			delete(params, "q")
+		}
+		parts := strings.SplitN(mediaType, "/", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		ret = append(ret, acceptRange{
+			typ:     parts[0],
+			subtype: parts[1],
+			q:       q,
+			params:  params,
+		})
+	}
+	return ret
+}
+
+// quality returns the quality factor the ranges assign to the mediaType. The
+// most specific matching range wins.
+func quality(ranges []acceptRange, mediaType string) float64 {
+	parts := strings.SplitN(mediaType, "/", 2)
+	q, specificity := 0.0, -1
+	for _, r := range ranges {
+		var s int
+		switch {
+		case r.typ == parts[0] && r.subtype == parts[1]:
+			s = 2
+		case r.typ == parts[0] && r.subtype == "*":
+			s = 1
+		case r.typ == "*" && r.subtype == "*":
+			s = 0
+		default:
+			continue
+		}
+		if s > specificity {
+			q, specificity = r.q, s
+		}
+	}
+	return q
+}
+
+// negotiateFormat picks Format for req. The format query parameter takes
+// precedence over the Accept header. Binary is served if the client does not
+// express any preference.
+func negotiateFormat(req *http.Request) (Format, error) {
+	if v := req.URL.Query().Get("format"); len(v) > 0 {
+		return ParseFormat(v)
+	}
+
+	ranges := parseAccept(req.Header.Get("Accept"))
+	if len(ranges) == 0 {
+		return Binary, nil
+	}
+
+	best, bestQ := Binary, 0.0
+	for _, f := range formats { // Ties go to the preferred format.
+		var q float64
+		for mediaType, g := range mediaTypes {
+			if g == f {
+				q = math.Max(q, quality(ranges, mediaType))
+			}
+		}
+		if q > bestQ {
+			best, bestQ = f, q
+		}
+	}
+	if bestQ == 0 {
+		return 0, errNotAcceptable
+	}
+	return best, nil
+}
@@ -0,0 +1,94 @@
+package fetch
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	transitrealtime "github.com/amwolff/google-gtfs-realtime-tools/gen/go"
+	"github.com/golang/protobuf/jsonpb"
+)
+
+// JSONOptions configure JSON encoding of FeedMessage.
+//
+// Whatever the options, the encoding follows the protocol buffers JSON
+// mapping, so its schema is derived from gtfs-realtime.proto: enums are
+// encoded as their names, 64-bit integers as strings and fields that are not
+// set are omitted.
+type JSONOptions struct {
+	// SnakeCase names fields as gtfs-realtime.proto does (e.g. "trip_update")
+	// instead of using lowerCamelCase ("tripUpdate").
+	SnakeCase bool
+	// Pretty indents the output.
+	Pretty bool
+}
+
+// MarshalJSON returns m encoded as JSON according to o and any error
+// encountered.
+func MarshalJSON(
+	m *transitrealtime.FeedMessage,
+	o JSONOptions) ([]byte, error) {
+
+	jm := &jsonpb.Marshaler{OrigName: o.SnakeCase}
+	if o.Pretty {
+		jm.Indent = "  "
+	}
+	b := &bytes.Buffer{}
+	if err := jm.Marshal(b, m); err != nil {
+		return nil, fmt.Errorf("Marshal: %w", err)
+	}
+	return b.Bytes(), nil
+}
+
+// Parameters that select JSONOptions. They're understood both as query
+// parameters and as parameters of the application/json media range in the
+// Accept header, e.g. ?format=json&case=snake&pretty=true or
+// Accept: application/json; case=snake; pretty=true.
+const (
+	JSONCaseParam   = "case"   // "camel" or "snake".
+	JSONPrettyParam = "pretty" // Anything strconv.ParseBool accepts.
+)
+
+var errInvalidJSONOptions = errors.New("invalid JSON options")
+
+// negotiateJSON returns def overridden by JSONOptions req asks for. Query
+// parameters take precedence over the Accept header.
+func negotiateJSON(req *http.Request, def JSONOptions) (JSONOptions, error) {
+	params := make(map[string]string)
+	for _, r := range parseAccept(req.Header.Get("Accept")) {
+		if r.typ == "application" && r.subtype == "json" {
+			for k, v := range r.params {
+				params[k] = v
+			}
+		}
+	}
+	q := req.URL.Query()
+	for _, k := range []string{JSONCaseParam, JSONPrettyParam} {
+		if v := q.Get(k); len(v) > 0 {
+			params[k] = v
+		}
+	}
+
+	ret := def
+	if v, ok := params[JSONCaseParam]; ok {
+		switch strings.ToLower(v) {
+		case "camel":
+			ret.SnakeCase = false
+		case "snake":
+			ret.SnakeCase = true
+		default:
+			return JSONOptions{}, errInvalidJSONOptions
+		}
+	}
+	if v, ok := params[JSONPrettyParam]; ok {
+		p, err := strconv.ParseBool(v)
+		if err != nil {
+			return JSONOptions{}, errInvalidJSONOptions
+		}
+		ret.Pretty = p
+	}
+	return ret, nil
+}
@@ -0,0 +1,203 @@
+package fetch
+
+import (
+	"context"
+	"net/http"
+
+	transitrealtime "github.com/amwolff/google-gtfs-realtime-tools/gen/go"
+	"github.com/amwolff/google-gtfs-realtime-tools/provider"
+	"github.com/golang/protobuf/proto"
+)
+
+// Paths served by Mux.
+const (
+	VehiclePositionsPath = "/vehicle-positions"
+	TripUpdatesPath      = "/trip-updates"
+	AlertsPath           = "/alerts"
+	CombinedPath         = "/"
+)
+
+// part is one of the feeds Mux splits the dataset into.
+type part struct {
+	cache *WithCache
+	// keep reports whether the entity belongs to the part and strips it of
+	// whatever doesn't.
+	keep func(e *transitrealtime.FeedEntity) *transitrealtime.FeedEntity
+	prev *transitrealtime.FeedMessage
+}
+
+// Mux is an http.Handler that splits GTFS-realtime dataset received from the
+// provider by entity type and serves vehicle positions, trip updates and
+// service alerts as separate feeds (at VehiclePositionsPath, TripUpdatesPath
+// and AlertsPath respectively), which is what Google and most consumers
+// expect. The unsplit dataset is served at CombinedPath.
+//
+// Every feed is served the way WithCache serves it and has its own cache. A
+// split feed keeps its header timestamp (and therefore its ETag) for as long
+// as its entities don't change, even if other parts of the dataset do.
+type Mux struct {
+	combined *WithCache
+	parts    map[string]*part
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func keepVehicle(e *transitrealtime.FeedEntity) *transitrealtime.FeedEntity {
+	if e.Vehicle == nil {
+		return nil
+	}
+	return &transitrealtime.FeedEntity{
+		Id:        e.Id,
+		IsDeleted: e.IsDeleted,
+		Vehicle:   e.Vehicle,
+	}
+}
+
+func keepTripUpdate(e *transitrealtime.FeedEntity) *transitrealtime.FeedEntity {
+	if e.TripUpdate == nil {
+		return nil
+	}
+	return &transitrealtime.FeedEntity{
+		Id:         e.Id,
+		IsDeleted:  e.IsDeleted,
+		TripUpdate: e.TripUpdate,
+	}
+}
+
+func keepAlert(e *transitrealtime.FeedEntity) *transitrealtime.FeedEntity {
+	if e.Alert == nil {
+		return nil
+	}
+	return &transitrealtime.FeedEntity{
+		Id:        e.Id,
+		IsDeleted: e.IsDeleted,
+		Alert:     e.Alert,
+	}
+}
+
+func entitiesEqual(a, b []*transitrealtime.FeedEntity) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !proto.Equal(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// split returns the part of m that p is interested in. Deleted entities
+// without any payload belong to every part.
+func (p *part) split(m *transitrealtime.FeedMessage) *transitrealtime.FeedMessage {
+	var entities []*transitrealtime.FeedEntity
+	for _, e := range m.GetEntity() {
+		if e.GetIsDeleted() &&
+			e.Vehicle == nil && e.TripUpdate == nil && e.Alert == nil {
+
+			entities = append(entities, e)
+			continue
+		}
+		if k := p.keep(e); k != nil {
+			entities = append(entities, k)
+		}
+	}
+	return &transitrealtime.FeedMessage{
+		Header: proto.Clone(m.GetHeader()).(*transitrealtime.FeedHeader),
+		Entity: entities,
+	}
+}
+
+func (x *Mux) store(m *transitrealtime.FeedMessage) {
+	x.combined.store(m)
+	for _, p := range x.parts {
+		s := p.split(m)
+		if p.prev != nil && entitiesEqual(p.prev.Entity, s.Entity) {
+			p.cache.touch()
+			continue
+		}
+		p.cache.store(s)
+		p.prev = s
+	}
+}
+
+func (x *Mux) preload(ctx context.Context, p provider.ContextFeedProvider) {
+	defer close(x.done)
+
+	err := provider.Consume(ctx, p, x.store)
+
+	x.combined.terminate(err)
+	for _, p := range x.parts {
+		p.cache.terminate(err)
+	}
+}
+
+// NewMux returns Mux that starts streaming from provider immediately. The
+// options apply to every served feed.
+func NewMux(p provider.FeedProvider, opts ...Option) *Mux {
+	return NewMuxContext(context.Background(), provider.AdaptLegacy(p), opts...)
+}
+
+// NewMuxContext is like NewMux but streams from provider.ContextFeedProvider
+// until ctx is done or Mux is closed.
+func NewMuxContext(
+	ctx context.Context,
+	p provider.ContextFeedProvider,
+	opts ...Option) *Mux {
+
+	ret := &Mux{
+		combined: newWithCache(opts...),
+		parts: map[string]*part{
+			VehiclePositionsPath: {cache: newWithCache(opts...), keep: keepVehicle},
+			TripUpdatesPath:      {cache: newWithCache(opts...), keep: keepTripUpdate},
+			AlertsPath:           {cache: newWithCache(opts...), keep: keepAlert},
+		},
+		done: make(chan struct{}),
+	}
+
+	ctx, ret.cancel = context.WithCancel(ctx)
+
+	go ret.preload(ctx, p)
+
+	return ret
+}
+
+// Shutdown is like WithCache's Shutdown.
+func (x *Mux) Shutdown(ctx context.Context) error {
+	x.cancel()
+	select {
+	case <-x.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close is like Shutdown but waits for the provider indefinitely.
+func (x *Mux) Close() error {
+	return x.Shutdown(context.Background())
+}
+
+// State returns the State of the combined feed.
+func (x *Mux) State() State {
+	return x.combined.State()
+}
+
+// Err is like WithCache's Err.
+func (x *Mux) Err() error {
+	return x.combined.Err()
+}
+
+func (x *Mux) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == CombinedPath {
+		x.combined.ServeHTTP(rw, req)
+		return
+	}
+	p, ok := x.parts[req.URL.Path]
+	if !ok {
+		http.NotFound(rw, req)
+		return
+	}
+	p.cache.ServeHTTP(rw, req)
+}
@@ -0,0 +1,118 @@
+package fetch
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	transitrealtime "github.com/amwolff/google-gtfs-realtime-tools/gen/go"
+	"github.com/amwolff/google-gtfs-realtime-tools/internal/providertest"
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+)
+
+// send sends m to c and returns once m has been processed. Since the channels
+// are unbuffered, m's processing must have finished by the time the provider
+// accepts the third message.
+func send(c providertest.Chan, m *transitrealtime.FeedMessage) {
+	for i := 0; i < 3; i++ {
+		c.C <- m
+	}
+}
+
+func getMixedFeedMessage(
+	timestamp uint64,
+	alertCause transitrealtime.Alert_Cause) *transitrealtime.FeedMessage {
+
+	return &transitrealtime.FeedMessage{
+		Header: &transitrealtime.FeedHeader{
+			GtfsRealtimeVersion: proto.String("2.0"),
+			Timestamp:           proto.Uint64(timestamp),
+		},
+		Entity: []*transitrealtime.FeedEntity{
+			{
+				Id: proto.String("vehicle"),
+				Vehicle: &transitrealtime.VehiclePosition{
+					Timestamp: proto.Uint64(timestamp),
+				},
+			},
+			{
+				Id: proto.String("trip"),
+				TripUpdate: &transitrealtime.TripUpdate{
+					Trip:      &transitrealtime.TripDescriptor{TripId: proto.String("t")},
+					Timestamp: proto.Uint64(timestamp),
+				},
+			},
+			{
+				Id:    proto.String("alert"),
+				Alert: &transitrealtime.Alert{Cause: &alertCause},
+			},
+			{
+				Id:        proto.String("gone"),
+				IsDeleted: proto.Bool(true),
+			},
+		},
+	}
+}
+
+func getFeedMessage(
+	t *testing.T,
+	h http.Handler,
+	path string) (*transitrealtime.FeedMessage, string) {
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	assert.Equal(t, http.StatusOK, rec.Code, path)
+	var ret transitrealtime.FeedMessage
+	assert.NoError(t, proto.Unmarshal(rec.Body.Bytes(), &ret))
+	return &ret, rec.Header().Get("ETag")
+}
+
+func TestMux(t *testing.T) {
+	c := providertest.NewChan(nil)
+	x := NewMuxContext(context.Background(), c)
+	defer x.Close()
+
+	send(c, getMixedFeedMessage(100, transitrealtime.Alert_STRIKE))
+
+	combined, _ := getFeedMessage(t, x, CombinedPath)
+	assert.Equal(t, []string{"vehicle", "trip", "alert", "gone"}, providertest.EntityIDs(combined))
+
+	vehicles, _ := getFeedMessage(t, x, VehiclePositionsPath)
+	assert.Equal(t, []string{"vehicle", "gone"}, providertest.EntityIDs(vehicles))
+	assert.Equal(t, uint64(100), vehicles.GetHeader().GetTimestamp())
+
+	trips, _ := getFeedMessage(t, x, TripUpdatesPath)
+	assert.Equal(t, []string{"trip", "gone"}, providertest.EntityIDs(trips))
+
+	alerts, alertsETag := getFeedMessage(t, x, AlertsPath)
+	assert.Equal(t, []string{"alert", "gone"}, providertest.EntityIDs(alerts))
+	assert.Equal(t, uint64(100), alerts.GetHeader().GetTimestamp())
+
+	// Alerts haven't changed, so they keep their timestamp and ETag.
+	send(c, getMixedFeedMessage(130, transitrealtime.Alert_STRIKE))
+
+	vehicles, _ = getFeedMessage(t, x, VehiclePositionsPath)
+	assert.Equal(t, uint64(130), vehicles.GetHeader().GetTimestamp())
+	alerts, etag := getFeedMessage(t, x, AlertsPath)
+	assert.Equal(t, uint64(100), alerts.GetHeader().GetTimestamp())
+	assert.Equal(t, alertsETag, etag)
+
+	send(c, getMixedFeedMessage(160, transitrealtime.Alert_WEATHER))
+
+	alerts, etag = getFeedMessage(t, x, AlertsPath)
+	assert.Equal(t, uint64(160), alerts.GetHeader().GetTimestamp())
+	assert.NotEqual(t, alertsETag, etag)
+
+	rec := httptest.NewRecorder()
+	x.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/shapes", nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	close(c.C)
+	assert.NoError(t, x.Close())
+	assert.Equal(t, Terminated, x.State())
+	rec = httptest.NewRecorder()
+	x.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, AlertsPath, nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+}
@@ -0,0 +1,119 @@
+package fetch
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	transitrealtime "github.com/amwolff/google-gtfs-realtime-tools/gen/go"
+)
+
+// variant identifies one representation of the dataset.
+type variant struct {
+	format   Format
+	json     JSONOptions // Zero unless format is JSON.
+	encoding string      // Content-Encoding; empty for identity.
+}
+
+func (v variant) marshal(m *transitrealtime.FeedMessage) ([]byte, error) {
+	if v.format == JSON {
+		return MarshalJSON(m, v.json)
+	}
+	return v.format.marshal(m)
+}
+
+// body is the encoded dataset along with its entity tag.
+type body struct {
+	b    []byte
+	etag string
+}
+
+// snapshot is GTFS-realtime dataset encoded once in every supported format.
+// It must not be modified after it has been created.
+type snapshot struct {
+	message      *transitrealtime.FeedMessage
+	versions     *versions
+	lastModified time.Time // Zero if the header has no timestamp.
+	bodies       map[variant]body
+}
+
+// getETag returns strong entity tag for v of the dataset whose binary encoding
+// hashes to sum. Representations differ between variants, so do their tags.
+func getETag(sum string, v variant) string {
+	if len(v.encoding) > 0 {
+		return fmt.Sprintf(`"%s-%s-%s"`, sum, v.format, v.encoding)
+	}
+	return fmt.Sprintf(`"%s-%s"`, sum, v.format)
+}
+
+// newBody returns m encoded as v and any error encountered. It's meant for
+// responses that can't be served from snapshot.
+func newBody(
+	m *transitrealtime.FeedMessage,
+	v variant,
+	compression map[string]int) (body, error) {
+
+	b, err := v.marshal(m)
+	if err != nil {
+		return body{}, fmt.Errorf("marshal (%v): %w", v.format, err)
+	}
+	if len(v.encoding) > 0 {
+		if b, err = compress(b, v.encoding, compression[v.encoding]); err != nil {
+			return body{}, fmt.Errorf("compress (%v): %w", v.format, err)
+		}
+	}
+	h := sha1.Sum(b)
+	return body{b: b, etag: fmt.Sprintf(`"%s"`, hex.EncodeToString(h[:]))}, nil
+}
+
+// newSnapshot returns snapshot of m and any error encountered. JSON is encoded
+// according to jsonOpts. Encoded formats are also compressed with every content
+// coding in compression (which maps codings to compression levels).
+func newSnapshot(
+	m *transitrealtime.FeedMessage,
+	compression map[string]int,
+	jsonOpts JSONOptions) (*snapshot, error) {
+
+	ret := &snapshot{
+		message: m,
+		bodies:  make(map[variant]body),
+	}
+	if t := m.GetHeader().GetTimestamp(); t > 0 {
+		ret.lastModified = time.Unix(int64(t), 0)
+	}
+
+	var sum string
+	for _, f := range formats {
+		v := variant{format: f}
+		if f == JSON {
+			v.json = jsonOpts
+		}
+		b, err := v.marshal(m)
+		if err != nil {
+			return nil, fmt.Errorf("marshal (%v): %w", f, err)
+		}
+		if f == Binary { // Binary always goes first.
+			h := sha1.Sum(b)
+			sum = hex.EncodeToString(h[:])
+		}
+
+		ret.bodies[v] = body{b: b, etag: getETag(sum, v)}
+
+		for _, e := range contentEncodings {
+			level, ok := compression[e]
+			if !ok {
+				continue
+			}
+			c, err := compress(b, e, level)
+			if err != nil {
+				return nil, fmt.Errorf("compress (%v, %s): %w", f, e, err)
+			}
+			cv := v
+			cv.encoding = e
+			ret.bodies[cv] = body{b: c, etag: getETag(sum, cv)}
+		}
+	}
+
+	return ret, nil
+}
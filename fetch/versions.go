@@ -0,0 +1,175 @@
+package fetch
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/amwolff/google-gtfs-realtime-tools/diff"
+	transitrealtime "github.com/amwolff/google-gtfs-realtime-tools/gen/go"
+	"github.com/golang/protobuf/proto"
+)
+
+// Every message received from the provider makes a new version of the
+// dataset. Clients learn the version they've got from VersionHeader and can
+// ask for what has changed since then with VersionParam.
+//
+// Versions are opaque tokens of the form "<epoch>-<n>". The epoch changes
+// every time WithCache is created, so that versions handed out before a
+// restart are never mistaken for current ones.
+const (
+	VersionHeader = "X-Feed-Version"
+	VersionParam  = "version"
+)
+
+// version is the parsed form of a version token.
+type version struct {
+	epoch string
+	n     uint64
+}
+
+func (v version) String() string {
+	return fmt.Sprintf("%s-%d", v.epoch, v.n)
+}
+
+// newEpoch returns a random epoch (or one derived from the current time if
+// there's no randomness available).
+func newEpoch() string {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(b)
+}
+
+// versions tracks in which version of the dataset its entities have changed.
+// It must not be modified after it has been created.
+type versions struct {
+	current uint64
+	oldest  uint64            // The oldest version differentials can be computed since.
+	changed map[string]uint64 // Entity ID to the version it was last added or modified in.
+	deleted map[string]uint64 // Entity ID to the version it was deleted in.
+}
+
+// merge applies m to prev, the full dataset whose versions are pv (either can
+// be nil if there's none yet), and returns the resulting full dataset along
+// with its versions. Deletions are remembered for history versions.
+//
+// FULL_DATASET messages replace prev and are returned as they are.
+// DIFFERENTIAL messages add or replace entities by ID and remove entities
+// marked as deleted.
+func merge(
+	prev *transitrealtime.FeedMessage,
+	pv *versions,
+	m *transitrealtime.FeedMessage,
+	history uint64) (*transitrealtime.FeedMessage, *versions) {
+
+	if pv == nil {
+		pv = &versions{}
+	}
+	ret := &versions{
+		current: pv.current + 1,
+		changed: make(map[string]uint64),
+		deleted: make(map[string]uint64),
+	}
+	if ret.current > history {
+		ret.oldest = ret.current - history
+	}
+	for id, v := range pv.deleted {
+		if v > ret.oldest {
+			ret.deleted[id] = v
+		}
+	}
+
+	old := make(map[string]*transitrealtime.FeedEntity)
+	for _, e := range prev.GetEntity() {
+		old[e.GetId()] = e
+	}
+
+	full := m
+	if m.GetHeader().GetIncrementality() == transitrealtime.FeedHeader_DIFFERENTIAL {
+		full = diff.Apply(prev, m)
+	}
+
+	for _, e := range full.GetEntity() {
+		id := e.GetId()
+		if o, ok := old[id]; ok && proto.Equal(o, e) {
+			ret.changed[id] = pv.changed[id]
+		} else {
+			ret.changed[id] = ret.current
+		}
+		delete(ret.deleted, id)
+		delete(old, id)
+	}
+	for id := range old { // Whatever is left is gone.
+		ret.deleted[id] = ret.current
+	}
+
+	return full, ret
+}
+
+// differential returns DIFFERENTIAL message with what has changed in full
+// (whose versions are vs) since version since. It returns false if that can't
+// be told, in which case clients need the full dataset.
+func differential(
+	full *transitrealtime.FeedMessage,
+	vs *versions,
+	since uint64) (*transitrealtime.FeedMessage, bool) {
+
+	if since == 0 || since < vs.oldest || since > vs.current {
+		return nil, false
+	}
+
+	header := &transitrealtime.FeedHeader{}
+	if full.GetHeader() != nil {
+		header = proto.Clone(full.GetHeader()).(*transitrealtime.FeedHeader)
+	}
+	differential := transitrealtime.FeedHeader_DIFFERENTIAL
+	header.Incrementality = &differential
+
+	ret := &transitrealtime.FeedMessage{Header: header}
+	for _, e := range full.GetEntity() {
+		if vs.changed[e.GetId()] > since {
+			ret.Entity = append(ret.Entity, e)
+		}
+	}
+	var deleted []string
+	for id, v := range vs.deleted {
+		if v > since {
+			deleted = append(deleted, id)
+		}
+	}
+	sort.Strings(deleted) // Same differentials must encode the same.
+	for _, id := range deleted {
+		ret.Entity = append(ret.Entity, &transitrealtime.FeedEntity{
+			Id:        proto.String(id),
+			IsDeleted: proto.Bool(true),
+		})
+	}
+	return ret, true
+}
+
+// parseVersion returns the version q asks for differential since (zero if it
+// doesn't) and any error encountered. Tokens without an epoch parse with an
+// empty one, which never matches.
+func parseVersion(q url.Values) (version, error) {
+	v := q.Get(VersionParam)
+	if len(v) == 0 {
+		return version{}, nil
+	}
+	var ret version
+	if i := strings.LastIndexByte(v, '-'); i >= 0 {
+		ret.epoch, v = v[:i], v[i+1:]
+	}
+	n, err := strconv.ParseUint(v, 10, 64)
+	if err != nil {
+		return version{}, fmt.Errorf("ParseUint: %w", err)
+	}
+	ret.n = n
+	return ret, nil
+}
@@ -0,0 +1,156 @@
+package fetch
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	transitrealtime "github.com/amwolff/google-gtfs-realtime-tools/gen/go"
+	"github.com/amwolff/google-gtfs-realtime-tools/internal/providertest"
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMerge(t *testing.T) {
+	full := transitrealtime.FeedHeader_FULL_DATASET
+	diff := transitrealtime.FeedHeader_DIFFERENTIAL
+
+	m1 := providertest.NewMessage(1, "a", "b", "c")
+	f, vs := merge(nil, nil, m1, 2)
+	assert.Equal(t, m1, f) // Full datasets are used as they are.
+	assert.Equal(t, uint64(1), vs.current)
+	assert.Equal(t, map[string]uint64{"a": 1, "b": 1, "c": 1}, vs.changed)
+
+	m2 := providertest.NewDifferential(2, "b", "-c", "d", "-x")
+	f, vs = merge(f, vs, m2, 2)
+	assert.Equal(t, full, f.GetHeader().GetIncrementality())
+	assert.Equal(t, uint64(2), f.GetHeader().GetTimestamp())
+	assert.Equal(t, []string{"a", "b", "d"}, providertest.EntityIDs(f))
+	assert.True(t, proto.Equal(m2.Entity[0], f.Entity[1]))
+	assert.Equal(t, map[string]uint64{"a": 1, "b": 2, "d": 2}, vs.changed)
+	assert.Equal(t, map[string]uint64{"c": 2}, vs.deleted)
+	assert.Equal(t, diff, m2.GetHeader().GetIncrementality()) // Not modified.
+
+	// Entities missing from full datasets are deleted too.
+	f, vs = merge(f, vs, providertest.NewMessage(1, "a", "c"), 2)
+	assert.Equal(t, map[string]uint64{"a": 1, "c": 3}, vs.changed)
+	assert.Equal(t, map[string]uint64{"b": 3, "d": 3}, vs.deleted)
+
+	// Deletions are forgotten after history versions.
+	f, vs = merge(f, vs, providertest.NewDifferential(2), 2)
+	f, vs = merge(f, vs, providertest.NewDifferential(2), 2)
+	assert.Equal(t, []string{"a", "c"}, providertest.EntityIDs(f))
+	assert.Equal(t, uint64(3), vs.oldest)
+	assert.Empty(t, vs.deleted)
+}
+
+func TestDifferential(t *testing.T) {
+	diff := transitrealtime.FeedHeader_DIFFERENTIAL
+
+	f, vs := merge(nil, nil, providertest.NewMessage(1, "a", "b", "c"), 10)
+	f, vs = merge(f, vs, providertest.NewDifferential(2, "-c", "-b", "d"), 10)
+	f, vs = merge(f, vs, providertest.NewDifferential(3, "e"), 10)
+
+	for i, tt := range []struct {
+		since    uint64
+		ok       bool
+		expected []string
+	}{
+		{since: 0},
+		{since: 1, ok: true, expected: []string{"d", "e", "b", "c"}},
+		{since: 2, ok: true, expected: []string{"e"}},
+		{since: 3, ok: true},
+		{since: 4},
+	} {
+		d, ok := differential(f, vs, tt.since)
+		assert.Equal(t, tt.ok, ok, i)
+		if !ok {
+			continue
+		}
+		assert.Equal(t, diff, d.GetHeader().GetIncrementality(), i)
+		assert.Equal(t, tt.expected, providertest.EntityIDs(d), i)
+	}
+}
+
+func TestWithCache_ServeHTTPVersion(t *testing.T) {
+	full := transitrealtime.FeedHeader_FULL_DATASET
+	diff := transitrealtime.FeedHeader_DIFFERENTIAL
+
+	h := newTestWithCache(providertest.NewMessage(1, "a", "b"), WithHistory(1))
+
+	get := func(path string) (*transitrealtime.FeedMessage, string) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		assert.Equal(t, http.StatusOK, rec.Code, path)
+		var ret transitrealtime.FeedMessage
+		assert.NoError(t, proto.Unmarshal(rec.Body.Bytes(), &ret))
+		return &ret, rec.Header().Get(VersionHeader)
+	}
+
+	m, version := get("/")
+	assert.Equal(t, h.epoch+"-1", version)
+	assert.Equal(t, []string{"a", "b"}, providertest.EntityIDs(m))
+
+	h.store(providertest.NewDifferential(2, "-a", "c"))
+
+	m, version = get("/")
+	assert.Equal(t, h.epoch+"-2", version)
+	assert.Equal(t, full, m.GetHeader().GetIncrementality())
+	assert.Equal(t, []string{"b", "c"}, providertest.EntityIDs(m))
+
+	m, version = get("/?version=" + h.epoch + "-1")
+	assert.Equal(t, h.epoch+"-2", version)
+	assert.Equal(t, diff, m.GetHeader().GetIncrementality())
+	assert.Equal(t, []string{"c", "a"}, providertest.EntityIDs(m))
+
+	h.store(providertest.NewDifferential(3, "d"))
+
+	// Version 1 is too old now; the full dataset has to do.
+	m, _ = get("/?version=" + h.epoch + "-1")
+	assert.Equal(t, full, m.GetHeader().GetIncrementality())
+	assert.Equal(t, []string{"b", "c", "d"}, providertest.EntityIDs(m))
+
+	m, _ = get("/?version=" + h.epoch + "-2&route_id=r")
+	assert.Equal(t, diff, m.GetHeader().GetIncrementality())
+	assert.Empty(t, m.GetEntity())
+
+	// Versions that haven't been handed out yet get the full dataset too.
+	m, _ = get("/?version=" + h.epoch + "-4")
+	assert.Equal(t, full, m.GetHeader().GetIncrementality())
+
+	for _, v := range []string{"x", h.epoch + "-x", h.epoch + "-"} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/?version="+v, nil))
+		assert.Equal(t, http.StatusBadRequest, rec.Code, v)
+	}
+}
+
+func TestWithCache_ServeHTTPVersionRestart(t *testing.T) {
+	full := transitrealtime.FeedHeader_FULL_DATASET
+
+	get := func(h *WithCache, version string) (*transitrealtime.FeedMessage, string) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/?version="+version, nil))
+		assert.Equal(t, http.StatusOK, rec.Code, version)
+		var ret transitrealtime.FeedMessage
+		assert.NoError(t, proto.Unmarshal(rec.Body.Bytes(), &ret))
+		return &ret, rec.Header().Get(VersionHeader)
+	}
+
+	before := newTestWithCache(providertest.NewMessage(1, "a", "b"))
+	before.store(providertest.NewDifferential(2, "c"))
+	_, old := get(before, "")
+
+	// After a restart the same version numbers describe other datasets.
+	after := newTestWithCache(providertest.NewMessage(1, "x"))
+	after.store(providertest.NewDifferential(2, "y"))
+	after.store(providertest.NewDifferential(3, "z"))
+	assert.NotEqual(t, before.epoch, after.epoch)
+
+	for _, v := range []string{old, "1", "-1"} {
+		m, current := get(after, v)
+		assert.Equal(t, full, m.GetHeader().GetIncrementality(), v)
+		assert.Equal(t, []string{"x", "y", "z"}, providertest.EntityIDs(m), v)
+		assert.Equal(t, after.epoch+"-3", current, v)
+	}
+}
@@ -0,0 +1,236 @@
+package fetch
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/amwolff/google-gtfs-realtime-tools/filter"
+	"github.com/gorilla/websocket"
+)
+
+// Subscription is what WebSocket clients send (as JSON text messages) to
+// change what they receive. Its fields mirror query parameters understood by
+// filter.Parse and the format query parameter; a Subscription replaces the
+// previous one entirely. The zero value means every entity in the binary
+// format.
+type Subscription struct {
+	RouteIDs    []string `json:"route_id,omitempty"`
+	TripIDs     []string `json:"trip_id,omitempty"`
+	StopIDs     []string `json:"stop_id,omitempty"`
+	AgencyIDs   []string `json:"agency_id,omitempty"`
+	VehicleIDs  []string `json:"vehicle_id,omitempty"`
+	BoundingBox string   `json:"bbox,omitempty"` // minLon,minLat,maxLon,maxLat
+	Format      string   `json:"format,omitempty"`
+}
+
+func (s Subscription) values() url.Values {
+	ret := url.Values{
+		filter.RouteIDParam:   s.RouteIDs,
+		filter.TripIDParam:    s.TripIDs,
+		filter.StopIDParam:    s.StopIDs,
+		filter.AgencyIDParam:  s.AgencyIDs,
+		filter.VehicleIDParam: s.VehicleIDs,
+	}
+	if len(s.BoundingBox) > 0 {
+		ret.Set(filter.BoundingBoxParam, s.BoundingBox)
+	}
+	if len(s.Format) > 0 {
+		ret.Set("format", s.Format)
+	}
+	return ret
+}
+
+const (
+	// wsWriteTimeout is how long a WebSocket client has to take a message
+	// before it's disconnected.
+	wsWriteTimeout = 10 * time.Second
+	// wsReadLimit is the maximum size of a message a WebSocket client can
+	// send. Subscriptions are much smaller.
+	wsReadLimit = 4 << 10
+)
+
+var upgrader = websocket.Upgrader{}
+
+// wsClient holds what a WebSocket client has subscribed to.
+type wsClient struct {
+	mu      sync.Mutex
+	flt     filter.Filter
+	v       variant
+	gen     int   // Incremented on every change.
+	err     error // Non-nil if the client has sent an invalid Subscription.
+	changed chan struct{}
+}
+
+func (c *wsClient) get() (filter.Filter, variant, int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.flt, c.v, c.gen, c.err
+}
+
+func (c *wsClient) set(flt filter.Filter, v variant, err error) {
+	c.mu.Lock()
+	c.flt, c.v, c.err = flt, v, err
+	c.gen++
+	c.mu.Unlock()
+
+	select {
+	case c.changed <- struct{}{}:
+	default: // The writer hasn't caught up with the previous change yet.
+	}
+}
+
+// parseSubscription returns filter.Filter and variant described by the query
+// parameters in q and any error encountered.
+func parseSubscription(
+	q url.Values,
+	jsonOpts JSONOptions) (filter.Filter, variant, error) {
+
+	flt, err := filter.Parse(q)
+	if err != nil {
+		return filter.Filter{}, variant{}, fmt.Errorf("Parse: %w", err)
+	}
+	v := variant{format: Binary, json: jsonOpts}
+	if f := q.Get("format"); len(f) > 0 {
+		if v.format, err = ParseFormat(f); err != nil {
+			return filter.Filter{}, variant{}, fmt.Errorf("ParseFormat: %w", err)
+		}
+	}
+	if v.format != JSON {
+		v.json = JSONOptions{}
+	}
+	return flt, v, nil
+}
+
+// readSubscriptions reads Subscriptions sent by the client until the
+// connection fails, which includes the client not answering a ping within
+// pongWait.
+func readSubscriptions(
+	conn *websocket.Conn,
+	c *wsClient,
+	jsonOpts JSONOptions,
+	pongWait time.Duration) {
+
+	conn.SetReadLimit(wsReadLimit)
+	conn.SetReadDeadline(time.Now().Add(pongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+
+	for {
+		_, b, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		var s Subscription
+		if err := json.Unmarshal(b, &s); err != nil {
+			c.set(filter.Filter{}, variant{}, fmt.Errorf("Unmarshal: %w", err))
+			continue
+		}
+		c.set(parseSubscription(s.values(), jsonOpts))
+	}
+}
+
+func closeWebSocket(conn *websocket.Conn, code int, text string) {
+	b := websocket.FormatCloseMessage(code, text)
+	conn.WriteControl(websocket.CloseMessage, b, time.Now().Add(wsWriteTimeout))
+}
+
+// serveWebSocket sends matching entities of every message received from the
+// provider to the WebSocket client until it goes away or w terminates. Binary
+// format is sent as binary messages; the other formats as text messages.
+//
+// A message is sent at most once and clients that can't keep up only get the
+// most recent one, so slow clients never hold up the provider. Clients that
+// don't take a message within wsWriteTimeout are disconnected. So are clients
+// that send messages larger than wsReadLimit or don't answer pings, which are
+// sent as often as event stream keep-alive comments.
+func (w *WithCache) serveWebSocket(rw http.ResponseWriter, req *http.Request) {
+	q := req.URL.Query()
+
+	jsonOpts, err := negotiateJSON(req, w.json)
+	if err != nil {
+		http.Error(rw, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	flt, v, err := parseSubscription(q, jsonOpts)
+	if err != nil {
+		http.Error(rw, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	conn, err := upgrader.Upgrade(rw, req, nil)
+	if err != nil {
+		return // Upgrade has already responded.
+	}
+	defer conn.Close()
+
+	c := &wsClient{flt: flt, v: v, changed: make(chan struct{}, 1)}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		readSubscriptions(conn, c, jsonOpts, 2*w.keepAlive)
+	}()
+
+	ping := time.NewTicker(w.keepAlive)
+	defer ping.Stop()
+
+	var (
+		sent    *snapshot
+		sentGen int
+	)
+	for {
+		w.mu.RLock()
+		s, closed, updated := w.recent, w.closed, w.updated
+		w.mu.RUnlock()
+
+		flt, v, gen, err := c.get()
+		if err != nil {
+			closeWebSocket(conn, websocket.CloseInvalidFramePayloadData, err.Error())
+			return
+		}
+
+		if s != nil && (s != sent || gen != sentGen) {
+			bd, ok := s.bodies[v]
+			if !ok || !flt.IsZero() {
+				if bd, err = newBody(flt.Apply(s.message), v, nil); err != nil {
+					closeWebSocket(conn, websocket.CloseInternalServerErr, "")
+					return
+				}
+			}
+			typ := websocket.TextMessage
+			if v.format == Binary {
+				typ = websocket.BinaryMessage
+			}
+			conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+			if err := conn.WriteMessage(typ, bd.b); err != nil {
+				return
+			}
+			sent, sentGen = s, gen
+		}
+
+		if closed {
+			closeWebSocket(conn, websocket.CloseGoingAway, "")
+			return
+		}
+
+		select {
+		case <-updated:
+		case <-c.changed:
+		case <-ping.C:
+			err := conn.WriteControl(
+				websocket.PingMessage,
+				nil,
+				time.Now().Add(wsWriteTimeout))
+			if err != nil {
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package fetch
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	transitrealtime "github.com/amwolff/google-gtfs-realtime-tools/gen/go"
+	"github.com/amwolff/google-gtfs-realtime-tools/internal/providertest"
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func mustDial(url string) *websocket.Conn {
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(url, "http"), nil)
+	if err != nil {
+		panic(fmt.Sprintf("Dial: %v", err))
+	}
+	return conn
+}
+
+// readFeedMessage reads FeedMessage encoded in the binary or JSON format.
+func readFeedMessage(t *testing.T, conn *websocket.Conn) *transitrealtime.FeedMessage {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	typ, b, err := conn.ReadMessage()
+	if err != nil {
+		panic(fmt.Sprintf("ReadMessage: %v", err))
+	}
+	var ret transitrealtime.FeedMessage
+	if typ == websocket.BinaryMessage {
+		assert.NoError(t, proto.Unmarshal(b, &ret))
+	} else {
+		assert.NoError(t, jsonpb.Unmarshal(bytes.NewReader(b), &ret))
+	}
+	return &ret
+}
+
+func TestWithCache_ServeHTTPWebSocket(t *testing.T) {
+	h := newTestWithCache(getMixedFeedMessage(1, transitrealtime.Alert_STRIKE))
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	all := mustDial(srv.URL)
+	defer all.Close()
+	trips := mustDial(srv.URL + "/?trip_id=t&format=json")
+	defer trips.Close()
+
+	assert.Len(t, readFeedMessage(t, all).GetEntity(), 4)
+	assert.Equal(t, []string{"trip", "gone"}, providertest.EntityIDs(readFeedMessage(t, trips)))
+
+	h.store(getMixedFeedMessage(2, transitrealtime.Alert_STRIKE))
+	m := readFeedMessage(t, all)
+	assert.Equal(t, uint64(2), m.GetHeader().GetTimestamp())
+	assert.Len(t, m.GetEntity(), 4)
+	assert.Equal(t, []string{"trip", "gone"}, providertest.EntityIDs(readFeedMessage(t, trips)))
+
+	// Changing the subscription makes the most recent message arrive again.
+	assert.NoError(t, all.WriteJSON(Subscription{Format: "json", BoundingBox: "0,0,1,1"}))
+	m = readFeedMessage(t, all)
+	assert.Equal(t, uint64(2), m.GetHeader().GetTimestamp())
+	assert.Equal(t, []string{"gone"}, providertest.EntityIDs(m))
+
+	// Invalid subscriptions close the connection.
+	assert.NoError(t, trips.WriteJSON(Subscription{BoundingBox: "1,2"}))
+	_, _, err := trips.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseInvalidFramePayloadData), err)
+
+	// So does the provider terminating.
+	h.terminate(nil)
+	_, _, err = all.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseGoingAway), err)
+}
+
+func TestWithCache_ServeHTTPWebSocketDeadClient(t *testing.T) {
+	h := newTestWithCache(getMixedFeedMessage(1, transitrealtime.Alert_STRIKE))
+	h.keepAlive = 10 * time.Millisecond
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	// Clients that don't answer pings are disconnected...
+	dead := mustDial(srv.URL)
+	defer dead.Close()
+	dead.SetPingHandler(func(string) error { return nil })
+
+	readFeedMessage(t, dead)
+	dead.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err := dead.ReadMessage()
+	assert.Error(t, err)
+	assert.False(t, isTimeout(err), err)
+
+	// ...and so are clients that send too much.
+	greedy := mustDial(srv.URL)
+	defer greedy.Close()
+
+	readFeedMessage(t, greedy)
+	assert.NoError(t, greedy.WriteMessage(websocket.TextMessage, make([]byte, wsReadLimit+1)))
+	greedy.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err = greedy.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseMessageTooBig), err)
+}
+
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+func TestWithCache_ServeHTTPWebSocketSlowClient(t *testing.T) {
+	h := newWithCache()
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	conn := mustDial(srv.URL)
+	defer conn.Close()
+
+	// The client doesn't read anything until the provider is done, which must
+	// not hold the provider up.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := uint64(1); i <= 1000; i++ {
+			h.store(getMixedFeedMessage(i, transitrealtime.Alert_STRIKE))
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("provider blocked by slow client")
+	}
+
+	// Updates are coalesced; the client eventually gets the most recent one.
+	for {
+		if m := readFeedMessage(t, conn); m.GetHeader().GetTimestamp() == 1000 {
+			break
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/?bbox=1", nil)
+	req.Header.Set("Connection", "upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	h.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
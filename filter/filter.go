@@ -0,0 +1,227 @@
+// Package filter implements selecting GTFS-realtime entities by the GTFS
+// entities they refer to (routes, trips, stops, agencies and vehicles) and by
+// their location.
+package filter
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	transitrealtime "github.com/amwolff/google-gtfs-realtime-tools/gen/go"
+	"github.com/golang/protobuf/proto"
+)
+
+// BoundingBox is an area delimited by WGS-84 coordinates.
+type BoundingBox struct {
+	MinLon, MinLat, MaxLon, MaxLat float64
+}
+
+// Contains reports whether p lies within b (inclusive).
+func (b BoundingBox) Contains(p *transitrealtime.Position) bool {
+	if p == nil || p.Latitude == nil || p.Longitude == nil {
+		return false
+	}
+	lat, lon := float64(p.GetLatitude()), float64(p.GetLongitude())
+	return lon >= b.MinLon && lon <= b.MaxLon &&
+		lat >= b.MinLat && lat <= b.MaxLat
+}
+
+// ParseBoundingBox parses BoundingBox from the "minLon,minLat,maxLon,maxLat"
+// form and returns any error encountered.
+func ParseBoundingBox(s string) (BoundingBox, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return BoundingBox{}, errors.New("want minLon,minLat,maxLon,maxLat")
+	}
+	var v [4]float64
+	for i, p := range parts {
+		f, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+		if err != nil {
+			return BoundingBox{}, fmt.Errorf("ParseFloat: %w", err)
+		}
+		v[i] = f
+	}
+	ret := BoundingBox{MinLon: v[0], MinLat: v[1], MaxLon: v[2], MaxLat: v[3]}
+	if ret.MinLon > ret.MaxLon || ret.MinLat > ret.MaxLat {
+		return BoundingBox{}, errors.New("minimums must not exceed maximums")
+	}
+	return ret, nil
+}
+
+// Filter selects entities. An entity matches Filter if it matches every
+// non-empty criterion; a criterion with several values matches if any of them
+// matches. Zero Filter matches every entity.
+//
+// Entities are matched by the GTFS entities they carry:
+//   - VehiclePosition by its trip's route and trip ID, stop ID, vehicle ID and
+//     position,
+//   - TripUpdate by its trip's route and trip ID, the stop IDs of its stop time
+//     updates and vehicle ID,
+//   - Alert by its informed entities, one of which has to satisfy every
+//     criterion on its own.
+//
+// An entity that doesn't carry the information a criterion needs (e.g. an
+// Alert given BoundingBox) does not match. Deleted entities without any
+// payload always match, since there is no way to tell what they referred to.
+type Filter struct {
+	RouteIDs    []string
+	TripIDs     []string
+	StopIDs     []string
+	AgencyIDs   []string
+	VehicleIDs  []string
+	BoundingBox *BoundingBox
+}
+
+// Query parameters understood by Parse.
+const (
+	RouteIDParam     = "route_id"
+	TripIDParam      = "trip_id"
+	StopIDParam      = "stop_id"
+	AgencyIDParam    = "agency_id"
+	VehicleIDParam   = "vehicle_id"
+	BoundingBoxParam = "bbox"
+)
+
+func getValues(q url.Values, key string) []string {
+	var ret []string
+	for _, v := range q[key] {
+		for _, s := range strings.Split(v, ",") {
+			if s = strings.TrimSpace(s); len(s) > 0 {
+				ret = append(ret, s)
+			}
+		}
+	}
+	return ret
+}
+
+// Parse returns Filter described by query parameters (e.g.
+// ?route_id=1,2&stop_id=3&bbox=8.5,47.3,8.6,47.4) and any error encountered.
+// Parameters can be repeated or hold comma-separated values. Unknown
+// parameters are ignored.
+func Parse(q url.Values) (Filter, error) {
+	ret := Filter{
+		RouteIDs:   getValues(q, RouteIDParam),
+		TripIDs:    getValues(q, TripIDParam),
+		StopIDs:    getValues(q, StopIDParam),
+		AgencyIDs:  getValues(q, AgencyIDParam),
+		VehicleIDs: getValues(q, VehicleIDParam),
+	}
+	if v := q.Get(BoundingBoxParam); len(v) > 0 {
+		b, err := ParseBoundingBox(v)
+		if err != nil {
+			return Filter{}, fmt.Errorf("ParseBoundingBox: %w", err)
+		}
+		ret.BoundingBox = &b
+	}
+	return ret, nil
+}
+
+// IsZero reports whether f matches every entity.
+func (f Filter) IsZero() bool {
+	return len(f.RouteIDs) == 0 &&
+		len(f.TripIDs) == 0 &&
+		len(f.StopIDs) == 0 &&
+		len(f.AgencyIDs) == 0 &&
+		len(f.VehicleIDs) == 0 &&
+		f.BoundingBox == nil
+}
+
+func contains(values []string, v string) bool {
+	if len(v) == 0 { // Absent.
+		return false
+	}
+	for _, x := range values {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
+
+// criterion checks a single criterion. It's satisfied if there are no values
+// to check against or if any of the candidates is one of them (so never if
+// there are values but no candidates).
+func criterion(values []string, candidates ...string) bool {
+	if len(values) == 0 {
+		return true
+	}
+	for _, c := range candidates {
+		if contains(values, c) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f Filter) matchVehicle(v *transitrealtime.VehiclePosition) bool {
+	return criterion(f.RouteIDs, v.GetTrip().GetRouteId()) &&
+		criterion(f.TripIDs, v.GetTrip().GetTripId()) &&
+		criterion(f.StopIDs, v.GetStopId()) &&
+		criterion(f.AgencyIDs) && // There's no agency to check against.
+		criterion(f.VehicleIDs, v.GetVehicle().GetId()) &&
+		(f.BoundingBox == nil || f.BoundingBox.Contains(v.Position))
+}
+
+func (f Filter) matchTripUpdate(u *transitrealtime.TripUpdate) bool {
+	var stops []string
+	for _, s := range u.GetStopTimeUpdate() {
+		stops = append(stops, s.GetStopId())
+	}
+	return criterion(f.RouteIDs, u.GetTrip().GetRouteId()) &&
+		criterion(f.TripIDs, u.GetTrip().GetTripId()) &&
+		criterion(f.StopIDs, stops...) &&
+		criterion(f.AgencyIDs) && // There's no agency to check against.
+		criterion(f.VehicleIDs, u.GetVehicle().GetId()) &&
+		f.BoundingBox == nil
+}
+
+func (f Filter) matchSelector(s *transitrealtime.EntitySelector) bool {
+	return criterion(f.RouteIDs, s.GetRouteId(), s.GetTrip().GetRouteId()) &&
+		criterion(f.TripIDs, s.GetTrip().GetTripId()) &&
+		criterion(f.StopIDs, s.GetStopId()) &&
+		criterion(f.AgencyIDs, s.GetAgencyId()) &&
+		criterion(f.VehicleIDs) && // There's no vehicle to check against.
+		f.BoundingBox == nil
+}
+
+func (f Filter) matchAlert(a *transitrealtime.Alert) bool {
+	for _, s := range a.GetInformedEntity() {
+		if f.matchSelector(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Match reports whether e matches f.
+func (f Filter) Match(e *transitrealtime.FeedEntity) bool {
+	if f.IsZero() {
+		return true
+	}
+	if e.Vehicle == nil && e.TripUpdate == nil && e.Alert == nil {
+		return e.GetIsDeleted()
+	}
+	return (e.Vehicle != nil && f.matchVehicle(e.Vehicle)) ||
+		(e.TripUpdate != nil && f.matchTripUpdate(e.TripUpdate)) ||
+		(e.Alert != nil && f.matchAlert(e.Alert))
+}
+
+// Apply returns FeedMessage that contains only the entities of m that match
+// f. The header is copied; entities are shared with m.
+func (f Filter) Apply(
+	m *transitrealtime.FeedMessage) *transitrealtime.FeedMessage {
+
+	ret := &transitrealtime.FeedMessage{}
+	if m.GetHeader() != nil {
+		ret.Header = proto.Clone(m.GetHeader()).(*transitrealtime.FeedHeader)
+	}
+	for _, e := range m.GetEntity() {
+		if f.Match(e) {
+			ret.Entity = append(ret.Entity, e)
+		}
+	}
+	return ret
+}
@@ -0,0 +1,126 @@
+package filter
+
+import (
+	"net/url"
+	"testing"
+
+	transitrealtime "github.com/amwolff/google-gtfs-realtime-tools/gen/go"
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParse(t *testing.T) {
+	q, err := url.ParseQuery("route_id=1,2&route_id=3&stop_id=+4+&trip_id=&bbox=8.5,47.3,8.6,47.4&x=y")
+	if err != nil {
+		panic(err)
+	}
+	f, err := Parse(q)
+	assert.NoError(t, err)
+	assert.Equal(t, Filter{
+		RouteIDs:    []string{"1", "2", "3"},
+		StopIDs:     []string{"4"},
+		BoundingBox: &BoundingBox{MinLon: 8.5, MinLat: 47.3, MaxLon: 8.6, MaxLat: 47.4},
+	}, f)
+	assert.False(t, f.IsZero())
+
+	f, err = Parse(url.Values{})
+	assert.NoError(t, err)
+	assert.True(t, f.IsZero())
+
+	for _, bbox := range []string{"1,2,3", "a,2,3,4", "3,2,1,4", "1,4,3,2"} {
+		_, err = Parse(url.Values{BoundingBoxParam: {bbox}})
+		assert.Error(t, err, bbox)
+	}
+}
+
+func getFeedMessage() *transitrealtime.FeedMessage {
+	return &transitrealtime.FeedMessage{
+		Header: &transitrealtime.FeedHeader{
+			GtfsRealtimeVersion: proto.String("2.0"),
+		},
+		Entity: []*transitrealtime.FeedEntity{
+			{
+				Id: proto.String("vehicle"),
+				Vehicle: &transitrealtime.VehiclePosition{
+					Trip: &transitrealtime.TripDescriptor{
+						TripId:  proto.String("t1"),
+						RouteId: proto.String("r1"),
+					},
+					Vehicle: &transitrealtime.VehicleDescriptor{Id: proto.String("v1")},
+					Position: &transitrealtime.Position{
+						Latitude:  proto.Float32(47.37),
+						Longitude: proto.Float32(8.54),
+					},
+					StopId: proto.String("s1"),
+				},
+			},
+			{
+				Id: proto.String("trip"),
+				TripUpdate: &transitrealtime.TripUpdate{
+					Trip: &transitrealtime.TripDescriptor{
+						TripId:  proto.String("t2"),
+						RouteId: proto.String("r2"),
+					},
+					StopTimeUpdate: []*transitrealtime.TripUpdate_StopTimeUpdate{
+						{StopId: proto.String("s1")},
+						{StopId: proto.String("s2")},
+					},
+				},
+			},
+			{
+				Id: proto.String("alert"),
+				Alert: &transitrealtime.Alert{
+					InformedEntity: []*transitrealtime.EntitySelector{
+						{AgencyId: proto.String("a1")},
+						{RouteId: proto.String("r1")},
+						{Trip: &transitrealtime.TripDescriptor{TripId: proto.String("t3")}},
+						{StopId: proto.String("s3")},
+						{RouteId: proto.String("r4"), StopId: proto.String("s4")},
+					},
+				},
+			},
+			{
+				Id:        proto.String("gone"),
+				IsDeleted: proto.Bool(true),
+			},
+		},
+	}
+}
+
+func TestFilter_Apply(t *testing.T) {
+	m := getFeedMessage()
+
+	for i, tt := range []struct {
+		f        Filter
+		expected []string
+	}{
+		{Filter{}, []string{"vehicle", "trip", "alert", "gone"}},
+		{Filter{RouteIDs: []string{"r1"}}, []string{"vehicle", "alert", "gone"}},
+		{Filter{RouteIDs: []string{"r1", "r2"}}, []string{"vehicle", "trip", "alert", "gone"}},
+		{Filter{TripIDs: []string{"t2", "t3"}}, []string{"trip", "alert", "gone"}},
+		{Filter{StopIDs: []string{"s1"}}, []string{"vehicle", "trip", "gone"}},
+		{Filter{StopIDs: []string{"s2"}}, []string{"trip", "gone"}},
+		{Filter{AgencyIDs: []string{"a1"}}, []string{"alert", "gone"}},
+		{Filter{VehicleIDs: []string{"v1"}}, []string{"vehicle", "gone"}},
+		{Filter{RouteIDs: []string{"r1"}, StopIDs: []string{"s2"}}, []string{"gone"}},
+		{Filter{RouteIDs: []string{"r1"}, StopIDs: []string{"s3"}}, []string{"gone"}},
+		{Filter{RouteIDs: []string{"r4"}, StopIDs: []string{"s4"}}, []string{"alert", "gone"}},
+		{
+			Filter{BoundingBox: &BoundingBox{MinLon: 8.5, MinLat: 47.3, MaxLon: 8.6, MaxLat: 47.4}},
+			[]string{"vehicle", "gone"},
+		},
+		{
+			Filter{BoundingBox: &BoundingBox{MinLon: 0, MinLat: 0, MaxLon: 1, MaxLat: 1}},
+			[]string{"gone"},
+		},
+	} {
+		var ids []string
+		for _, e := range tt.f.Apply(m).GetEntity() {
+			ids = append(ids, e.GetId())
+		}
+		assert.Equal(t, tt.expected, ids, i)
+	}
+
+	// Apply doesn't modify m.
+	assert.True(t, proto.Equal(getFeedMessage(), m))
+}
@@ -0,0 +1,125 @@
+// Package providertest contains implementations of the provider.FeedProvider
+// and provider.ContextFeedProvider for tests of packages that consume them, and
+// messages for them to stream.
+package providertest
+
+import (
+	"context"
+
+	transitrealtime "github.com/amwolff/google-gtfs-realtime-tools/gen/go"
+	"github.com/golang/protobuf/proto"
+)
+
+// Chan streams the messages sent on C and returns Err once C is closed.
+type Chan struct {
+	C   chan *transitrealtime.FeedMessage
+	Err error
+}
+
+// NewChan returns Chan with an unbuffered channel that returns err once the
+// channel is closed.
+func NewChan(err error) Chan {
+	return Chan{C: make(chan *transitrealtime.FeedMessage), Err: err}
+}
+
+func (c Chan) Stream(feed chan<- *transitrealtime.FeedMessage) {
+	c.StreamContext(context.Background(), feed)
+}
+
+func (c Chan) StreamContext(
+	ctx context.Context,
+	feed chan<- *transitrealtime.FeedMessage) error {
+
+	defer close(feed)
+	for {
+		select {
+		case m, ok := <-c.C:
+			if !ok {
+				return c.Err
+			}
+			select {
+			case feed <- m:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Slice streams Messages and returns Err.
+type Slice struct {
+	Messages []*transitrealtime.FeedMessage
+	Err      error
+}
+
+func (s Slice) Stream(feed chan<- *transitrealtime.FeedMessage) {
+	s.StreamContext(context.Background(), feed)
+}
+
+func (s Slice) StreamContext(
+	ctx context.Context,
+	feed chan<- *transitrealtime.FeedMessage) error {
+
+	defer close(feed)
+	for _, m := range s.Messages {
+		select {
+		case feed <- m:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return s.Err
+}
+
+// NewMessage returns FULL_DATASET FeedMessage with the given header timestamp
+// and an entity with VehiclePosition (timestamped the same) for every ID. IDs
+// prefixed with "-" become deleted entities without payload instead.
+func NewMessage(timestamp uint64, ids ...string) *transitrealtime.FeedMessage {
+	return newMessage(transitrealtime.FeedHeader_FULL_DATASET, timestamp, ids)
+}
+
+// NewDifferential is like NewMessage but returns DIFFERENTIAL FeedMessage.
+func NewDifferential(timestamp uint64, ids ...string) *transitrealtime.FeedMessage {
+	return newMessage(transitrealtime.FeedHeader_DIFFERENTIAL, timestamp, ids)
+}
+
+func newMessage(
+	incrementality transitrealtime.FeedHeader_Incrementality,
+	timestamp uint64,
+	ids []string) *transitrealtime.FeedMessage {
+
+	ret := &transitrealtime.FeedMessage{
+		Header: &transitrealtime.FeedHeader{
+			GtfsRealtimeVersion: proto.String("2.0"),
+			Incrementality:      &incrementality,
+			Timestamp:           proto.Uint64(timestamp),
+		},
+	}
+	for _, id := range ids {
+		if len(id) > 0 && id[0] == '-' {
+			ret.Entity = append(ret.Entity, &transitrealtime.FeedEntity{
+				Id:        proto.String(id[1:]),
+				IsDeleted: proto.Bool(true),
+			})
+			continue
+		}
+		ret.Entity = append(ret.Entity, &transitrealtime.FeedEntity{
+			Id: proto.String(id),
+			Vehicle: &transitrealtime.VehiclePosition{
+				Timestamp: proto.Uint64(timestamp),
+			},
+		})
+	}
+	return ret
+}
+
+// EntityIDs returns the IDs of m's entities in order.
+func EntityIDs(m *transitrealtime.FeedMessage) []string {
+	var ret []string
+	for _, e := range m.GetEntity() {
+		ret = append(ret, e.GetId())
+	}
+	return ret
+}
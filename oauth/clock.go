@@ -0,0 +1,58 @@
+package oauth
+
+import "time"
+
+// Clock is the interface that wraps the time operations Client depends on, so
+// that token expiration can be tested without waiting.
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+}
+
+// Timer is the interface that wraps time.Timer.
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTimer(d time.Duration) Timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+type realTimer struct {
+	t *time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time {
+	return t.t.C
+}
+
+func (t realTimer) Stop() bool {
+	return t.t.Stop()
+}
+
+// WithClock makes Client use c instead of the system clock.
+func WithClock(c Clock) Option {
+	return func(cl *Client) {
+		cl.clock = c
+	}
+}
+
+// DefaultExpirySkew is how long before its expiration Access Token is
+// refreshed by default.
+const DefaultExpirySkew = 10 * time.Second
+
+// WithExpirySkew makes Client refresh Access Token d before it expires, so
+// that uploads issued in the last moments of its validity aren't rejected.
+// Tokens are kept for at least half of their lifetime regardless of d.
+func WithExpirySkew(d time.Duration) Option {
+	return func(c *Client) {
+		c.skew = d
+	}
+}
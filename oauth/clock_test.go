@@ -0,0 +1,348 @@
+package oauth
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	transitrealtime "github.com/amwolff/google-gtfs-realtime-tools/gen/go"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeClock is a Clock whose time only moves on Advance.
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers map[*fakeTimer]struct{}
+}
+
+type fakeTimer struct {
+	clock *fakeClock
+	c     chan time.Time
+	at    time.Time
+}
+
+func newFakeClock(now time.Time) *fakeClock {
+	return &fakeClock{now: now, timers: make(map[*fakeTimer]struct{})}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t := &fakeTimer{clock: c, c: make(chan time.Time, 1), at: c.now.Add(d)}
+	if d <= 0 {
+		t.c <- c.now
+		return t
+	}
+	c.timers[t] = struct{}{}
+	return t
+}
+
+// Advance moves the clock forward by d, firing timers that are due.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+	for t := range c.timers {
+		if !t.at.After(c.now) {
+			t.c <- c.now
+			delete(c.timers, t)
+		}
+	}
+}
+
+// waitTimer waits (in real time) until there's a pending timer and returns
+// when it's due.
+func (c *fakeClock) waitTimer() time.Time {
+	for {
+		c.mu.Lock()
+		for t := range c.timers {
+			c.mu.Unlock()
+			return t.at
+		}
+		c.mu.Unlock()
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+
+	_, ok := t.clock.timers[t]
+	delete(t.clock.timers, t)
+	return ok
+}
+
+func mustLoadClientSecretsFile() *os.File {
+	f, err := os.Open(filepath.Clean("./testdata/client_secrets.json"))
+	if err != nil {
+		panic(fmt.Sprintf("Open: %v", err))
+	}
+	return f
+}
+
+func TestClient_isAccessTokenExpiredSkew(t *testing.T) {
+	now := time.Date(2020, time.February, 7, 15, 0, 0, 0, time.UTC)
+	clock := newFakeClock(now)
+
+	s := &MemoryTokenStore{}
+	if err := s.Save(Tokens{ExpirationDate: now.Add(time.Hour)}); err != nil {
+		panic(fmt.Sprintf("Save: %v", err))
+	}
+
+	secretFile := mustLoadClientSecretsFile()
+	defer secretFile.Close()
+
+	client, err := NewClient(
+		nil,
+		secretFile,
+		"",
+		DefaultTokenExchangeURL,
+		"",
+		"",
+		WithTokenStore(s),
+		WithClock(clock),
+		WithExpirySkew(time.Minute))
+	assert.NoError(t, err)
+
+	assert.False(t, client.isAccessTokenExpired())
+	clock.Advance(58 * time.Minute)
+	assert.False(t, client.isAccessTokenExpired())
+	clock.Advance(time.Minute)
+	assert.True(t, client.isAccessTokenExpired())
+}
+
+// idleProvider sends nothing until ctx is done.
+type idleProvider struct{}
+
+func (idleProvider) StreamContext(
+	ctx context.Context,
+	feed chan<- *transitrealtime.FeedMessage) error {
+
+	defer close(feed)
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestClient_RunContextRefresh(t *testing.T) {
+	now := time.Date(2020, time.February, 7, 15, 0, 0, 0, time.UTC)
+	clock := newFakeClock(now)
+
+	var exchanges int32
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&exchanges, 1)
+		fmt.Fprint(w, `{"access_token":"c0a3b7e2-5f1d-4e8a-9b6c-2d4f6a8c0e1b",`+
+			`"expires_in":3600,"token_type":"Bearer"}`)
+	}))
+	defer ts.Close()
+
+	s := &MemoryTokenStore{}
+	if err := s.Save(Tokens{
+		AccessToken:    "8e2f4a6c-0b1d-4c3e-9f5a-7b9d1e3f5a7c",
+		ExpirationDate: now.Add(time.Hour),
+		TokenType:      "Bearer",
+		RefreshToken:   "4b6d8f0a-2c4e-4a6b-8d0f-1a3c5e7b9d2f",
+	}); err != nil {
+		panic(fmt.Sprintf("Save: %v", err))
+	}
+
+	secretFile := mustLoadClientSecretsFile()
+	defer secretFile.Close()
+
+	client, err := NewClient(
+		ts.Client(),
+		secretFile,
+		"",
+		ts.URL,
+		"",
+		"",
+		WithTokenStore(s),
+		WithClock(clock),
+		WithExpirySkew(time.Minute))
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() {
+		errc <- client.RunContext(
+			ctx,
+			idleProvider{},
+			"feed.pb",
+			"2483663d-56ce-44cd-a63f-74bb63eb6f24",
+			"93681f64-00a4-471a-998c-24bc9e80eca3")
+	}()
+
+	// Access Token is refreshed a minute before it expires...
+	at := clock.waitTimer()
+	assert.Equal(t, now.Add(59*time.Minute), at)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&exchanges))
+
+	clock.Advance(at.Sub(now))
+
+	// ...and then again a minute before the new one expires.
+	assert.Equal(t, at.Add(59*time.Minute), clock.waitTimer())
+	assert.Equal(t, int32(1), atomic.LoadInt32(&exchanges))
+
+	saved, err := s.Load()
+	assert.NoError(t, err)
+	assert.Equal(t, "c0a3b7e2-5f1d-4e8a-9b6c-2d4f6a8c0e1b", saved.AccessToken)
+	assert.Equal(t, at.Add(time.Hour), saved.ExpirationDate)
+
+	cancel()
+	assert.Equal(t, context.Canceled, <-errc)
+}
+
+func TestClient_UploadFeedMessageUnauthorized(t *testing.T) {
+	const (
+		revoked   = "3d5f7b9e-1a2c-4e6f-8a0b-2c4e6f8a0b1d"
+		refreshed = "9f1b3d5e-7a9c-4b1d-8f3a-5c7e9a1b3d5f"
+	)
+
+	for _, acceptRefreshed := range []bool{true, false} {
+		var exchanges, uploads int32
+
+		mux := http.NewServeMux()
+		mux.HandleFunc("/tokens", func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&exchanges, 1)
+			fmt.Fprintf(w, `{"access_token":"%s","expires_in":3600,"token_type":"Bearer"}`, refreshed)
+		})
+		mux.HandleFunc("/upload", func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&uploads, 1)
+			if !acceptRefreshed || r.Header.Get("Authorization") != getBearer(refreshed) {
+				w.WriteHeader(http.StatusUnauthorized)
+			}
+		})
+
+		ts := httptest.NewTLSServer(mux)
+
+		s := &MemoryTokenStore{}
+		if err := s.Save(Tokens{
+			AccessToken:    revoked,
+			ExpirationDate: time.Now().Add(time.Hour),
+			TokenType:      "Bearer",
+			RefreshToken:   "4b6d8f0a-2c4e-4a6b-8d0f-1a3c5e7b9d2f",
+		}); err != nil {
+			panic(fmt.Sprintf("Save: %v", err))
+		}
+
+		secretFile := mustLoadClientSecretsFile()
+
+		client, err := NewClient(
+			ts.Client(),
+			secretFile,
+			"",
+			fmt.Sprint(ts.URL, "/tokens"),
+			"",
+			fmt.Sprint(ts.URL, "/upload"),
+			WithTokenStore(s))
+		assert.NoError(t, err)
+
+		err = client.UploadFeedMessage(
+			"2483663d-56ce-44cd-a63f-74bb63eb6f24",
+			"93681f64-00a4-471a-998c-24bc9e80eca3",
+			FeedMessageWrapper{
+				Name: "feed.pb",
+				File: bytes.NewReader([]byte("feed")),
+			})
+		if acceptRefreshed {
+			assert.NoError(t, err)
+		} else {
+			var se *StatusError
+			assert.True(t, errors.As(err, &se))
+			assert.Equal(t, http.StatusUnauthorized, se.StatusCode)
+		}
+
+		// Retried once, after a single refresh.
+		assert.Equal(t, int32(1), atomic.LoadInt32(&exchanges))
+		assert.Equal(t, int32(2), atomic.LoadInt32(&uploads))
+		assert.Equal(t, refreshed, client.getTokens().AccessToken)
+
+		secretFile.Close()
+		ts.Close()
+	}
+}
+
+func TestClient_RunContextRefreshSkewExceedingLifetime(t *testing.T) {
+	now := time.Date(2020, time.February, 7, 15, 0, 0, 0, time.UTC)
+	clock := newFakeClock(now)
+
+	var exchanges int32
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&exchanges, 1)
+		fmt.Fprint(w, `{"access_token":"c0a3b7e2-5f1d-4e8a-9b6c-2d4f6a8c0e1b",`+
+			`"expires_in":3600,"token_type":"Bearer"}`)
+	}))
+	defer ts.Close()
+
+	s := &MemoryTokenStore{}
+	if err := s.Save(Tokens{
+		AccessToken:    "8e2f4a6c-0b1d-4c3e-9f5a-7b9d1e3f5a7c",
+		ExpirationDate: now.Add(time.Hour),
+		TokenType:      "Bearer",
+		RefreshToken:   "4b6d8f0a-2c4e-4a6b-8d0f-1a3c5e7b9d2f",
+	}); err != nil {
+		panic(fmt.Sprintf("Save: %v", err))
+	}
+
+	secretFile := mustLoadClientSecretsFile()
+	defer secretFile.Close()
+
+	client, err := NewClient(
+		ts.Client(),
+		secretFile,
+		"",
+		ts.URL,
+		"",
+		"",
+		WithTokenStore(s),
+		WithClock(clock),
+		WithExpirySkew(2*time.Hour))
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() {
+		errc <- client.RunContext(
+			ctx,
+			idleProvider{},
+			"feed.pb",
+			"2483663d-56ce-44cd-a63f-74bb63eb6f24",
+			"93681f64-00a4-471a-998c-24bc9e80eca3")
+	}()
+
+	// Loaded tokens are refreshed right away...
+	at := clock.waitTimer()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&exchanges))
+
+	// ...but the new ones are kept for half an hour rather than none at all.
+	assert.Equal(t, now.Add(30*time.Minute), at)
+
+	clock.Advance(30 * time.Minute)
+	assert.Equal(t, now.Add(time.Hour), clock.waitTimer())
+	assert.Equal(t, int32(2), atomic.LoadInt32(&exchanges))
+
+	cancel()
+	assert.Equal(t, context.Canceled, <-errc)
+}
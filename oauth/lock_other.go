@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd,!dragonfly
+
+package oauth
+
+// lockFile does nothing on platforms without flock(2). Writes of the token
+// file are still atomic, but other processes writing it aren't held off.
+func lockFile(path string) (func(), error) {
+	return func() {}, nil
+}
@@ -0,0 +1,44 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+// +build linux darwin freebsd netbsd openbsd dragonfly
+
+package oauth
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLockFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oauth-test")
+	if err != nil {
+		panic(fmt.Sprintf("TempDir: %v", err))
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "tokens.lock")
+
+	unlock, err := lockFile(path)
+	assert.NoError(t, err)
+
+	locked := make(chan func())
+	go func() {
+		unlock, err := lockFile(path)
+		assert.NoError(t, err)
+		locked <- unlock
+	}()
+
+	select {
+	case <-locked:
+		t.Fatal("lock taken twice")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	unlock()
+	(<-locked)()
+}
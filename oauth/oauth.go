@@ -4,6 +4,7 @@ package oauth
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -13,6 +14,7 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"sync"
 	"time"
 
 	transitrealtime "github.com/amwolff/google-gtfs-realtime-tools/gen/go"
@@ -38,20 +40,35 @@ type clientSecret struct {
 	} `json:"installed"`
 }
 
-type tokenData struct {
+// Tokens are the credentials Client obtains from Google and keeps in its
+// TokenStore.
+type Tokens struct {
 	AccessToken    string    `json:"access_token"`
 	ExpirationDate time.Time `json:"expiration_date"`
 	TokenType      string    `json:"token_type"`
 	RefreshToken   string    `json:"refresh_token"`
 }
 
+// Client is safe for concurrent use.
 type Client struct {
 	httpClient       *http.Client
 	secret           clientSecret
-	tokens           tokenData
 	tokenExchangeURL string
-	cachePath        string
+	store            TokenStore
 	feedUploadURL    string
+	retry            *RetryPolicy
+	onError          func(err error)
+	uploadTimeout    time.Duration
+	clock            Clock
+	skew             time.Duration
+
+	// refreshing is a one-slot semaphore held during refresh, so that
+	// there's only one. Unlike a mutex, waiting for it respects ctx.
+	refreshing chan struct{}
+
+	mu     sync.Mutex
+	tokens Tokens
+	issued time.Time // When tokens were obtained (zero if they were loaded).
 }
 
 type exchangeResponse struct {
@@ -62,34 +79,42 @@ type exchangeResponse struct {
 }
 
 func doExchange(
+	ctx context.Context,
 	tokenExchangeURL string,
 	form io.Reader,
 	contentType string,
-	httpClient *http.Client) (tokenData, error) {
+	httpClient *http.Client,
+	clock Clock) (Tokens, error) {
 
 	req, err := http.NewRequest(http.MethodPost, tokenExchangeURL, form)
 	if err != nil {
-		return tokenData{}, fmt.Errorf("NewRequest: %w", err)
+		return Tokens{}, fmt.Errorf("NewRequest: %w", err)
 	}
+	req = req.WithContext(ctx)
 	req.Header.Set("Content-Type", contentType)
 
-	now := time.Now()
+	now := clock.Now()
 	res, err := httpClient.Do(req)
 	if err != nil {
-		return tokenData{}, fmt.Errorf("Do: %w", err)
+		return Tokens{}, fmt.Errorf("Do: %w", err)
 	}
 	defer res.Body.Close()
 
 	if res.StatusCode != http.StatusOK {
-		return tokenData{}, fmt.Errorf("non-200 status: %s", res.Status)
+		content, _ := ioutil.ReadAll(res.Body)
+		return Tokens{}, fmt.Errorf("non-200 status: %w", &StatusError{
+			StatusCode: res.StatusCode,
+			Status:     res.Status,
+			Body:       content,
+		})
 	}
 
 	var xchRes exchangeResponse
 	if err := json.NewDecoder(res.Body).Decode(&xchRes); err != nil {
-		return tokenData{}, fmt.Errorf("Decode: %w", err)
+		return Tokens{}, fmt.Errorf("Decode: %w", err)
 	}
 
-	ret := tokenData{
+	ret := Tokens{
 		AccessToken:    xchRes.AccessToken,
 		ExpirationDate: now.Add(time.Duration(xchRes.ExpiresIn) * time.Second),
 		TokenType:      xchRes.TokenType,
@@ -106,7 +131,7 @@ type FeedMessageWrapper struct {
 	File io.Reader
 }
 
-func createRFC2388Form(values map[string]interface{}) (io.Reader, string, error) {
+func createRFC2388Form(values map[string]interface{}) (*bytes.Buffer, string, error) {
 	// NOTICE: this could be done a little bit better (?):
 	//         1. Create better wrapper type for gtfs-realtime feed (??)
 	//         2. Use mime/multipart.Form instead of map[string]interface{} (???)
@@ -138,10 +163,12 @@ func createRFC2388Form(values map[string]interface{}) (io.Reader, string, error)
 }
 
 func exchangeForTokens(
+	ctx context.Context,
 	authorizationCode string,
 	secret clientSecret,
 	tokenExchangeURL string,
-	httpClient *http.Client) (tokenData, error) {
+	httpClient *http.Client,
+	clock Clock) (Tokens, error) {
 
 	form, contentType, err := createRFC2388Form(map[string]interface{}{
 		"code":          authorizationCode,
@@ -151,10 +178,16 @@ func exchangeForTokens(
 		"grant_type":    "authorization_code",
 	})
 	if err != nil {
-		return tokenData{}, fmt.Errorf("createRFC2388Form: %w", err)
+		return Tokens{}, fmt.Errorf("createRFC2388Form: %w", err)
 	}
 
-	tokens, err := doExchange(tokenExchangeURL, form, contentType, httpClient)
+	tokens, err := doExchange(
+		ctx,
+		tokenExchangeURL,
+		form,
+		contentType,
+		httpClient,
+		clock)
 	if err != nil {
 		return tokens, fmt.Errorf("doExchange: %w", err)
 	}
@@ -162,19 +195,51 @@ func exchangeForTokens(
 	return tokens, nil
 }
 
-func writeTokensToFile(tokens tokenData, path string) error {
+// writeTokensToFile replaces the file at path with tokens. The file is never
+// left partially written: tokens are written to a temporary file which is
+// then renamed. Concurrent writers (including other processes) are serialized
+// with a lock on path + ".lock".
+func writeTokensToFile(tokens Tokens, path string) (err error) {
 	b, err := json.Marshal(tokens)
 	if err != nil {
 		return fmt.Errorf("Marshal: %w", err)
 	}
-	if err := ioutil.WriteFile(path, b, 0600); err != nil {
-		return fmt.Errorf("WriteFile: %w", err)
+
+	unlock, err := lockFile(path + ".lock")
+	if err != nil {
+		return fmt.Errorf("lockFile: %w", err)
+	}
+	defer unlock()
+
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("TempFile: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+
+	if _, err := f.Write(b); err != nil {
+		return fmt.Errorf("Write: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("Sync: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("Close: %w", err)
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return fmt.Errorf("Rename: %w", err)
 	}
 	return nil
 }
 
 // NewClient returns initialized Client and any error encountered. It performs
-// exchange automatically if no tokens have been found in the tokensCachePath.
+// exchange automatically if no tokens have been found in the token store,
+// which is the JSON file at tokensCachePath unless WithTokenStore is given.
 //
 // clientSecretJSON file should be the default one provided by Google.
 func NewClient(
@@ -183,95 +248,177 @@ func NewClient(
 	tokensCachePath,
 	tokenExchangeURL,
 	authorizationCode,
-	feedUploadURL string) (*Client, error) {
+	feedUploadURL string,
+	opts ...Option) (*Client, error) {
+
+	return NewClientContext(
+		context.Background(),
+		httpClient,
+		clientSecretJSON,
+		tokensCachePath,
+		tokenExchangeURL,
+		authorizationCode,
+		feedUploadURL,
+		opts...)
+}
+
+// NewClientContext is like NewClient but the exchange (if any) is bound to
+// ctx.
+func NewClientContext(
+	ctx context.Context,
+	httpClient *http.Client,
+	clientSecretJSON io.Reader,
+	tokensCachePath,
+	tokenExchangeURL,
+	authorizationCode,
+	feedUploadURL string,
+	opts ...Option) (*Client, error) {
+
+	retry := DefaultRetryPolicy
+	ret := &Client{
+		httpClient:       httpClient,
+		tokenExchangeURL: tokenExchangeURL,
+		feedUploadURL:    feedUploadURL,
+		retry:            &retry,
+		onError:          func(error) {},
+		uploadTimeout:    DefaultUploadTimeout,
+		clock:            realClock{},
+		skew:             DefaultExpirySkew,
+		refreshing:       make(chan struct{}, 1),
+	}
+	for _, o := range opts {
+		o(ret)
+	}
+
+	if len(tokenExchangeURL) == 0 ||
+		(ret.store == nil && len(tokensCachePath) == 0) {
 
-	if len(tokenExchangeURL) == 0 || len(tokensCachePath) == 0 {
 		return nil, errors.New("CachePath/ExchangeURL must not be empty")
 	}
+	if ret.store == nil {
+		ret.store = FileTokenStore(filepath.Clean(tokensCachePath))
+	}
 
-	var secret clientSecret
-	if err := json.NewDecoder(clientSecretJSON).Decode(&secret); err != nil {
+	if err := json.NewDecoder(clientSecretJSON).Decode(&ret.secret); err != nil {
 		return nil, fmt.Errorf("Decode: %w", err)
 	}
 
-	cleanCachePath := filepath.Clean(tokensCachePath)
-	if _, err := os.Stat(cleanCachePath); !os.IsNotExist(err) {
-		// No authorization needed - fast path.
-		b, err := ioutil.ReadFile(cleanCachePath)
-		if err != nil {
-			return nil, fmt.Errorf("ReadFile: %w", err)
-		}
-		var tokens tokenData
-		if err := json.Unmarshal(b, &tokens); err != nil {
-			return nil, fmt.Errorf("Unmarshal: %w", err)
-		}
-		return &Client{
-			httpClient:       httpClient,
-			secret:           secret,
-			tokens:           tokens,
-			tokenExchangeURL: tokenExchangeURL,
-			cachePath:        cleanCachePath,
-			feedUploadURL:    feedUploadURL,
-		}, nil
+	tokens, err := ret.store.Load()
+	if err == nil { // No authorization needed - fast path.
+		ret.tokens = tokens
+		return ret, nil
+	}
+	if !errors.Is(err, ErrNoTokens) {
+		return nil, fmt.Errorf("Load: %w", err)
 	}
 
-	tokens, err := exchangeForTokens(
+	issued := ret.clock.Now()
+	tokens, err = exchangeForTokens(
+		ctx,
 		authorizationCode,
-		secret,
+		ret.secret,
 		tokenExchangeURL,
-		httpClient)
+		httpClient,
+		ret.clock)
 	if err != nil {
 		return nil, fmt.Errorf("exchangeForTokens: %w", err)
 	}
 
-	if err := writeTokensToFile(tokens, cleanCachePath); err != nil {
-		return nil, fmt.Errorf("writeTokensToFile: %w", err)
+	if err := ret.store.Save(tokens); err != nil {
+		return nil, fmt.Errorf("Save: %w", err)
 	}
 
-	return &Client{
-		httpClient:       httpClient,
-		secret:           secret,
-		tokens:           tokens,
-		tokenExchangeURL: tokenExchangeURL,
-		cachePath:        cleanCachePath,
-		feedUploadURL:    feedUploadURL,
-	}, nil
+	ret.tokens, ret.issued = tokens, issued
+	return ret, nil
 }
 
-func (c Client) isAccessTokenExpired() bool {
-	return time.Now().After(c.tokens.ExpirationDate)
+// getTokens returns a copy of c's current tokens.
+func (c *Client) getTokens() Tokens {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.tokens
 }
 
-func (c *Client) maybeRefreshAccessToken() error {
-	if !c.isAccessTokenExpired() {
+// isAccessTokenExpired reports whether Access Token has expired or is about
+// to (see WithExpirySkew).
+func (c *Client) isAccessTokenExpired() bool {
+	return !c.clock.Now().Before(c.refreshAt())
+}
+
+// refreshAt returns the time at which Access Token needs to be refreshed. For
+// tokens Client has obtained itself it's never earlier than halfway through
+// their lifetime, so that a skew exceeding it doesn't make Client refresh them
+// over and over.
+func (c *Client) refreshAt() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ret := c.tokens.ExpirationDate.Add(-c.skew)
+	if c.issued.IsZero() {
+		return ret
+	}
+	if half := c.issued.Add(c.tokens.ExpirationDate.Sub(c.issued) / 2); ret.Before(half) {
+		return half
+	}
+	return ret
+}
+
+func (c *Client) maybeRefreshAccessToken(ctx context.Context) error {
+	return c.refreshAccessToken(ctx, "")
+}
+
+// refreshAccessToken refreshes Access Token if it has expired or if it's
+// still the rejected one (if not empty). Callers that find it expired while
+// another one is refreshing it wait for that refresh instead of starting
+// their own (unless ctx is done first).
+func (c *Client) refreshAccessToken(ctx context.Context, rejected string) error {
+	select {
+	case c.refreshing <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-c.refreshing }()
+
+	current := c.getTokens()
+	if !c.isAccessTokenExpired() &&
+		(rejected == "" || current.AccessToken != rejected) {
+
 		return nil
 	}
 
 	form, contentType, err := createRFC2388Form(map[string]interface{}{
 		"client_id":     c.secret.Installed.ClientID,
 		"client_secret": c.secret.Installed.ClientSecret,
-		"refresh_token": c.tokens.RefreshToken,
+		"refresh_token": current.RefreshToken,
 		"grant_type":    "refresh_token",
 	})
+	if err != nil {
+		return fmt.Errorf("createRFC2388Form: %w", err)
+	}
 
+	issued := c.clock.Now()
 	tokens, err := doExchange(
+		ctx,
 		c.tokenExchangeURL,
 		form,
 		contentType,
-		c.httpClient)
+		c.httpClient,
+		c.clock)
 	if err != nil {
 		return fmt.Errorf("doExchange: %w", err)
 	}
 
 	if len(tokens.RefreshToken) == 0 { // TODO: most likely drop this branch.
-		tokens.RefreshToken = c.tokens.RefreshToken
+		tokens.RefreshToken = current.RefreshToken
 	}
 
-	if err := writeTokensToFile(tokens, c.cachePath); err != nil {
-		return fmt.Errorf("writeTokensToFile: %w", err)
+	if err := c.store.Save(tokens); err != nil {
+		return fmt.Errorf("Save: %w", err)
 	}
 
-	c.tokens = tokens
+	c.mu.Lock()
+	c.tokens, c.issued = tokens, issued
+	c.mu.Unlock()
 
 	return nil
 }
@@ -280,10 +427,47 @@ func getBearer(token string) string {
 	return fmt.Sprintf("Bearer %s", token)
 }
 
+// upload sends the form with the given Access Token.
+func (c *Client) upload(
+	ctx context.Context,
+	form []byte,
+	contentType, accessToken string) error {
+
+	req, err := http.NewRequest(http.MethodPost, c.feedUploadURL, bytes.NewReader(form))
+	if err != nil {
+		return fmt.Errorf("NewRequest: %w", err)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Authorization", getBearer(accessToken))
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("Do: %w", err)
+	}
+	defer res.Body.Close()
+
+	content, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return fmt.Errorf("ReadAll: %w", err)
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return &StatusError{
+			StatusCode: res.StatusCode,
+			Status:     res.Status,
+			Body:       content,
+		}
+	}
+
+	return nil
+}
+
 // UploadFeedMessage uploads GTFS-realtime dataset and returns any error
 // encountered.
 //
-// It automatically refreshes Access Token.
+// It automatically refreshes Access Token. If the upload is rejected with 401
+// Unauthorized, Access Token is refreshed and the upload is retried once.
 //
 // The alkaliAccountID is the value of the "a" parameter in the Transit Partner
 // Dashboard page URL.
@@ -291,6 +475,20 @@ func (c *Client) UploadFeedMessage(
 	alkaliAccountID, realtimeFeedID string,
 	wrapper FeedMessageWrapper) error {
 
+	return c.UploadFeedMessageContext(
+		context.Background(),
+		alkaliAccountID,
+		realtimeFeedID,
+		wrapper)
+}
+
+// UploadFeedMessageContext is like UploadFeedMessage but the upload (and
+// refreshing Access Token) is bound to ctx, e.g. to give it a timeout.
+func (c *Client) UploadFeedMessageContext(
+	ctx context.Context,
+	alkaliAccountID, realtimeFeedID string,
+	wrapper FeedMessageWrapper) error {
+
 	form, contentType, err := createRFC2388Form(map[string]interface{}{
 		"alkali_application_name": "transit",
 		"alkali_account_id":       alkaliAccountID,
@@ -299,34 +497,29 @@ func (c *Client) UploadFeedMessage(
 		"realtime_feed_id":        realtimeFeedID,
 		"file":                    wrapper,
 	})
+	if err != nil {
+		return fmt.Errorf("createRFC2388Form: %w", err)
+	}
 
-	if err := c.maybeRefreshAccessToken(); err != nil {
+	if err := c.maybeRefreshAccessToken(ctx); err != nil {
 		return fmt.Errorf("maybeRefreshAccessToken: %w", err)
 	}
 
-	req, err := http.NewRequest(http.MethodPost, c.feedUploadURL, form)
-	if err != nil {
-		return fmt.Errorf("NewRequest: %w", err)
-	}
-	req.Header.Set("Content-Type", contentType)
-	req.Header.Set("Authorization", getBearer(c.tokens.AccessToken))
+	accessToken := c.getTokens().AccessToken
 
-	res, err := c.httpClient.Do(req)
-	if err != nil {
-		return fmt.Errorf("Do: %w", err)
-	}
-	defer res.Body.Close()
+	err = c.upload(ctx, form.Bytes(), contentType, accessToken)
 
-	content, err := ioutil.ReadAll(res.Body)
-	if err != nil {
-		return fmt.Errorf("ReadAll: %w", err)
+	var se *StatusError
+	if !errors.As(err, &se) || se.StatusCode != http.StatusUnauthorized {
+		return err
 	}
 
-	if res.StatusCode != http.StatusOK {
-		return fmt.Errorf("%s: %q", res.Status, content)
+	// Access Token may have been revoked or expired earlier than expected.
+	if err := c.refreshAccessToken(ctx, accessToken); err != nil {
+		return fmt.Errorf("refreshAccessToken: %w", err)
 	}
 
-	return nil
+	return c.upload(ctx, form.Bytes(), contentType, c.getTokens().AccessToken)
 }
 
 var ErrChanClosed = errors.New("streaming channel is closed")
@@ -334,7 +527,8 @@ var ErrChanClosed = errors.New("streaming channel is closed")
 // Run makes it easier for Data Sources to push GTFS-realtime dataset
 // continuously. Data Source is an implementation of the provider.FeedProvider.
 //
-// It automatically refreshes Access Token.
+// It automatically refreshes Access Token and retries transient failures (see
+// RetryPolicy), so a single failed upload doesn't stop it.
 //
 // The alkaliAccountID is the value of the "a" parameter in the Transit Partner
 // Dashboard page URL.
@@ -342,25 +536,143 @@ func (c *Client) Run(
 	feedProvider provider.FeedProvider,
 	feedFilename, alkaliAccountID, realtimeFeedID string) error {
 
+	return c.RunContext(
+		context.Background(),
+		provider.AdaptLegacy(feedProvider),
+		feedFilename,
+		alkaliAccountID,
+		realtimeFeedID)
+}
+
+// DefaultUploadTimeout is how long a single upload made by RunContext can take
+// by default.
+const DefaultUploadTimeout = time.Minute
+
+// WithUploadTimeout bounds every upload made by RunContext (and Run),
+// including refreshing Access Token it may need, by d. Since cancelling
+// RunContext does not interrupt the upload in progress, d also bounds how long
+// RunContext takes to return. If d <= 0 uploads are not bounded.
+func WithUploadTimeout(d time.Duration) Option {
+	return func(c *Client) {
+		c.uploadTimeout = d
+	}
+}
+
+// detachedContext carries the values of Context but is never done.
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+// uploadContext returns the context of an upload made by RunContext. It keeps
+// ctx's values but not its cancellation, so that the upload is drained rather
+// than aborted, and is bounded by the upload timeout instead.
+func (c *Client) uploadContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if c.uploadTimeout <= 0 {
+		return context.WithCancel(detachedContext{ctx})
+	}
+	return context.WithTimeout(detachedContext{ctx}, c.uploadTimeout)
+}
+
+// RunContext is like Run but streams from provider.ContextFeedProvider until
+// ctx is done, in which case it returns ctx.Err(). If the provider terminates
+// with an error RunContext returns it (wrapped); ErrChanClosed is returned if
+// the provider has finished without an error.
+//
+// Failed uploads are retried according to Client's RetryPolicy (see
+// WithRetryPolicy and WithoutRetry); failures that aren't retried make
+// RunContext return the error. Failures that are retried (or end with the
+// message being dropped) are reported with WithErrorHandler.
+//
+// Cancelling ctx does not interrupt the upload in progress (see
+// WithUploadTimeout). RunContext lets it finish, stops the provider, waits for
+// it to return and only then returns itself, so that no goroutines are left
+// behind. Refreshing Access Token in advance, between uploads, is interrupted.
+func (c *Client) RunContext(
+	ctx context.Context,
+	feedProvider provider.ContextFeedProvider,
+	feedFilename, alkaliAccountID, realtimeFeedID string) error {
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
 	feed := make(chan *transitrealtime.FeedMessage)
+	errc := make(chan error, 1)
+
+	go func() { errc <- feedProvider.StreamContext(ctx, feed) }()
 
-	go feedProvider.Stream(feed)
+	var stopped bool
+	defer func() { // Make sure the provider is done before returning.
+		if !stopped {
+			cancel()
+			for range feed {
+			}
+			<-errc
+		}
+	}()
+
+	// closed returns what RunContext returns once the provider has closed
+	// its channel.
+	closed := func() error {
+		stopped = true
+		err := <-errc
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			return fmt.Errorf("StreamContext: %w", err)
+		}
+		return ErrChanClosed
+	}
 
+	var (
+		msg     *transitrealtime.FeedMessage // Not uploaded yet.
+		attempt int
+	)
 	for {
-		if err := c.maybeRefreshAccessToken(); err != nil {
-			return fmt.Errorf("maybeRefreshAccessToken: %w", err)
+		if err := ctx.Err(); err != nil {
+			return err
 		}
 
-		var msg *transitrealtime.FeedMessage
-		select {
-		case m, ok := <-feed:
-			if ok {
-				msg = m
+		if msg == nil {
+			var (
+				refresh  Timer
+				refreshC <-chan time.Time // Nil if refreshing has failed.
+			)
+			if err := c.maybeRefreshAccessToken(ctx); err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				if !c.retryable(err) {
+					return fmt.Errorf("maybeRefreshAccessToken: %w", err)
+				}
+				// UploadFeedMessage will refresh it (and be retried).
+				c.onError(fmt.Errorf("maybeRefreshAccessToken: %w", err))
 			} else {
-				return ErrChanClosed
+				refresh = c.clock.NewTimer(c.refreshAt().Sub(c.clock.Now()))
+				refreshC = refresh.C()
+			}
+
+			select {
+			case m, ok := <-feed:
+				if refresh != nil {
+					refresh.Stop()
+				}
+				if !ok {
+					return closed()
+				}
+				msg, attempt = m, 0
+			case <-refreshC:
+				continue // Refresh Access Token in advance.
+			case <-ctx.Done():
+				if refresh != nil {
+					refresh.Stop()
+				}
+				return ctx.Err()
 			}
-		case <-time.After(c.tokens.ExpirationDate.Sub(time.Now())):
-			continue // Refresh Access Token in advance.
 		}
 
 		b, err := proto.Marshal(msg)
@@ -368,15 +680,53 @@ func (c *Client) Run(
 			return fmt.Errorf("Marshal: %w", err)
 		}
 
-		if err := c.UploadFeedMessage(
+		uctx, cancelUpload := c.uploadContext(ctx)
+		err = c.UploadFeedMessageContext(
+			uctx,
 			alkaliAccountID,
 			realtimeFeedID,
 			FeedMessageWrapper{
 				Name: feedFilename,
 				File: bytes.NewReader(b),
-			}); err != nil {
+			})
+		cancelUpload()
+		if err == nil {
+			msg = nil
+			continue
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if !c.retryable(err) {
+			return fmt.Errorf("UploadFeedMessageContext: %w", err)
+		}
+
+		if attempt++; c.retry.MaxAttempts > 0 && attempt >= c.retry.MaxAttempts {
+			c.onError(&DroppedError{Attempts: attempt, Err: err})
+			msg = nil
+			continue
+		}
+
+		c.onError(fmt.Errorf("UploadFeedMessageContext: %w", err))
+		backoff := c.retry.backoff(attempt)
 
-			return fmt.Errorf("UploadFeedMessage: %w", err)
+		var newer <-chan *transitrealtime.FeedMessage
+		if c.retry.DropStale {
+			newer = feed
+		}
+
+		retry := c.clock.NewTimer(backoff)
+		select {
+		case <-retry.C():
+		case m, ok := <-newer:
+			retry.Stop()
+			if !ok {
+				return closed()
+			}
+			msg, attempt = m, 0
+		case <-ctx.Done():
+			retry.Stop()
+			return ctx.Err()
 		}
 	}
 }
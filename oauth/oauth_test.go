@@ -2,7 +2,9 @@ package oauth
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"mime"
@@ -11,9 +13,15 @@ import (
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	transitrealtime "github.com/amwolff/google-gtfs-realtime-tools/gen/go"
+	"github.com/amwolff/google-gtfs-realtime-tools/internal/providertest"
+	"github.com/golang/protobuf/proto"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -224,19 +232,28 @@ func getRunUploadHandler(t *testing.T, file []byte) http.HandlerFunc {
 	}
 }
 
-func mustLoadCachedTokens(path string) tokenData {
+func mustLoadCachedTokens(path string) Tokens {
 	b, err := ioutil.ReadFile(path)
 	if err != nil {
 		panic(fmt.Sprintf("ReadFile: %v", err))
 	}
-	var ret tokenData
+	var ret Tokens
 	if err := json.Unmarshal(b, &ret); err != nil {
 		panic(fmt.Sprintf("Unmarshal: %v", err))
 	}
 	return ret
 }
 
-func checkTokensEquality(t *testing.T, expected, actual tokenData) {
+// removeTokensFile removes the tokens file at path along with the lock file
+// writeTokensToFile leaves next to it.
+func removeTokensFile(path string) {
+	if err := os.Remove(path); err != nil {
+		panic(fmt.Sprintf("Remove: %v", err))
+	}
+	os.Remove(path + ".lock") // Not there if tokens were only read.
+}
+
+func checkTokensEquality(t *testing.T, expected, actual Tokens) {
 	assert.Equal(t, expected.AccessToken, actual.AccessToken)
 	assert.Equal(t, expected.TokenType, actual.TokenType)
 	assert.Equal(t, expected.RefreshToken, actual.RefreshToken)
@@ -333,7 +350,7 @@ func TestExchangeForTokens(t *testing.T) {
 	ts := httptest.NewTLSServer(getExchangeForTokensHandler(t, code, secret))
 	defer ts.Close()
 
-	tokens, err := exchangeForTokens(code, secret, ts.URL, ts.Client())
+	tokens, err := exchangeForTokens(context.Background(), code, secret, ts.URL, ts.Client(), realClock{})
 	assert.NoError(t, err)
 
 	assert.Equal(t, "1/fFAGRNJru1FTz70BzhT3Zg", tokens.AccessToken)
@@ -346,7 +363,7 @@ func TestWriteTokensToFile(t *testing.T) {
 	tokensPath := filepath.Clean("/tmp/9ce8d8af-41a5-41bb-bfd7-a6dc85b0b6eb")
 
 	for i := 0; i < 24; i++ {
-		tokens := tokenData{
+		tokens := Tokens{
 			AccessToken:    "3163948a-3624-4ab6-b198-afe6ca88216a",
 			ExpirationDate: time.Date(1949, time.June, 8, i, i, i, i, time.UTC),
 			TokenType:      "Bearer",
@@ -357,9 +374,7 @@ func TestWriteTokensToFile(t *testing.T) {
 	}
 
 	// Cleanup.
-	if err := os.Remove(tokensPath); err != nil {
-		panic(fmt.Sprintf("Remove: %v", err))
-	}
+	removeTokensFile(tokensPath)
 }
 
 func TestNewClient(t *testing.T) {
@@ -388,7 +403,7 @@ func TestNewClient(t *testing.T) {
 		DefaultFeedUploadURL)
 	assert.NoError(t, err)
 
-	tokens := tokenData{
+	tokens := Tokens{
 		AccessToken:    "9cddb84a-5ab4-4ee4-9abc-cd53183b45bd",
 		ExpirationDate: time.Now().Add(1337 * time.Second),
 		TokenType:      "Bearer",
@@ -401,7 +416,7 @@ func TestNewClient(t *testing.T) {
 	assert.Equal(t, tsClient, client.httpClient)
 	assert.Equal(t, secret, client.secret)
 	assert.Equal(t, ts.URL, client.tokenExchangeURL)
-	assert.Equal(t, cleanTokensPath, client.cachePath)
+	assert.Equal(t, FileTokenStore(cleanTokensPath), client.store)
 	assert.Equal(t, DefaultFeedUploadURL, client.feedUploadURL)
 
 	// Assert internal state: test internal token storage and cache.
@@ -409,9 +424,7 @@ func TestNewClient(t *testing.T) {
 	checkTokensEquality(t, tokens, client.tokens)
 
 	// Cleanup.
-	if err := os.Remove(cleanTokensPath); err != nil {
-		panic(fmt.Sprintf("Remove: %v", err))
-	}
+	removeTokensFile(cleanTokensPath)
 }
 
 func TestNewClientFastPath(t *testing.T) {
@@ -444,7 +457,7 @@ func TestNewClientFastPath(t *testing.T) {
 	assert.Equal(t, tsClient, client.httpClient)
 	assert.Equal(t, secret, client.secret)
 	assert.Equal(t, ts.URL, client.tokenExchangeURL)
-	assert.Equal(t, filepath.Clean(tokensPath), client.cachePath)
+	assert.Equal(t, FileTokenStore(filepath.Clean(tokensPath)), client.store)
 	assert.Equal(t, DefaultFeedUploadURL, client.feedUploadURL)
 
 	l, err := time.LoadLocation("Europe/Zurich")
@@ -454,7 +467,7 @@ func TestNewClientFastPath(t *testing.T) {
 	// 2020-02-07T15:04:48.870053479+01:00
 	expirationDate := time.Date(2020, time.February, 7, 15, 4, 48, 870053479, l)
 
-	tokens := tokenData{
+	tokens := Tokens{
 		AccessToken:    "b65dce0c-c66f-4c08-83ad-803f451e0a26",
 		ExpirationDate: expirationDate,
 		TokenType:      "Bearer",
@@ -508,9 +521,7 @@ func TestClient_isAccessTokenExpired(t *testing.T) {
 	assert.True(t, clientWithExpired.isAccessTokenExpired())
 
 	// Cleanup.
-	if err := os.Remove(cleanTokensPath); err != nil {
-		panic(fmt.Sprintf("Remove: %v", err))
-	}
+	removeTokensFile(cleanTokensPath)
 }
 
 func TestClient_maybeRefreshAccessToken(t *testing.T) {
@@ -549,9 +560,9 @@ func TestClient_maybeRefreshAccessToken(t *testing.T) {
 		DefaultFeedUploadURL)
 	assert.NoError(t, err)
 
-	assert.NoError(t, client.maybeRefreshAccessToken())
+	assert.NoError(t, client.maybeRefreshAccessToken(context.Background()))
 
-	tokens := tokenData{
+	tokens := Tokens{
 		AccessToken:    "1/fFAGRNJru1FTz70BzhT3Zg",
 		ExpirationDate: time.Now().Add(3920 * time.Second),
 		TokenType:      "Bearer",
@@ -562,7 +573,7 @@ func TestClient_maybeRefreshAccessToken(t *testing.T) {
 	assert.Equal(t, tsClient, client.httpClient)
 	assert.Equal(t, secret, client.secret)
 	assert.Equal(t, ts.URL, client.tokenExchangeURL)
-	assert.Equal(t, cleanTokensPath, client.cachePath)
+	assert.Equal(t, FileTokenStore(cleanTokensPath), client.store)
 	assert.Equal(t, DefaultFeedUploadURL, client.feedUploadURL)
 
 	// Assert internal state: test internal token storage and cache.
@@ -571,13 +582,11 @@ func TestClient_maybeRefreshAccessToken(t *testing.T) {
 
 	// Make sure isAccessTokenExpired is properly called.
 	for i := 0; i < 100; i++ {
-		assert.NoError(t, client.maybeRefreshAccessToken())
+		assert.NoError(t, client.maybeRefreshAccessToken(context.Background()))
 	}
 
 	// Cleanup.
-	if err := os.Remove(cleanTokensPath); err != nil {
-		panic(fmt.Sprintf("Remove: %v", err))
-	}
+	removeTokensFile(cleanTokensPath)
 }
 
 func TestClient_UploadFeedMessage(t *testing.T) {
@@ -638,7 +647,7 @@ func TestClient_UploadFeedMessage(t *testing.T) {
 				File: bytes.NewReader(b),
 			}))
 
-	tokens := tokenData{
+	tokens := Tokens{
 		AccessToken:    "ba25ffba-a2b7-4d34-8225-e9477bc94619",
 		ExpirationDate: time.Now().Add(3920 * time.Second),
 		TokenType:      "Bearer",
@@ -649,7 +658,7 @@ func TestClient_UploadFeedMessage(t *testing.T) {
 	assert.Equal(t, tsClient, client.httpClient)
 	assert.Equal(t, secret, client.secret)
 	assert.Equal(t, tokensURL, client.tokenExchangeURL)
-	assert.Equal(t, cleanTokensPath, client.cachePath)
+	assert.Equal(t, FileTokenStore(cleanTokensPath), client.store)
 	assert.Equal(t, uploadURL, client.feedUploadURL)
 
 	// Assert internal state: test internal token storage and cache.
@@ -657,9 +666,7 @@ func TestClient_UploadFeedMessage(t *testing.T) {
 	checkTokensEquality(t, tokens, client.tokens)
 
 	// Cleanup.
-	if err := os.Remove(cleanTokensPath); err != nil {
-		panic(fmt.Sprintf("Remove: %v", err))
-	}
+	removeTokensFile(cleanTokensPath)
 }
 
 func TestClient_Run(t *testing.T) {
@@ -678,3 +685,476 @@ func TestClient_Run(t *testing.T) {
 	// }
 	// defer secretFile.Close()
 }
+
+func getRunContextUploadHandler(t *testing.T, uploads *int32) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer 2c6a5f0e-6bb1-4d24-9b8e-1a4b0b5c30d2", r.Header.Get("Authorization"))
+		atomic.AddInt32(uploads, 1)
+	}
+}
+
+func mustNewRunContextClient(uploadURL string, httpClient *http.Client) (*Client, string) {
+	secretFile, err := os.Open(filepath.Clean("./testdata/client_secrets.json"))
+	if err != nil {
+		panic(fmt.Sprintf("Open: %v", err))
+	}
+	defer secretFile.Close()
+
+	tokensPath := filepath.Clean("/tmp/b3b5d7b2-8d4a-4b8e-a0b5-6a1f3c0f9f4e")
+	if err := ioutil.WriteFile(
+		tokensPath,
+		[]byte(fmt.Sprintf(`{"access_token":"2c6a5f0e-6bb1-4d24-9b8e-1a4b0b5c30d2",`+
+			`"expiration_date":"%s","token_type":"Bearer","refresh_token":"`+
+			`0e0b6f8c-4c55-4f1b-8f2b-3c5d3d5e0a11"}`,
+			time.Now().Add(time.Hour).Format(time.RFC3339Nano))),
+		0600); err != nil {
+
+		panic(fmt.Sprintf("WriteFile: %v", err))
+	}
+
+	client, err := NewClient(
+		httpClient,
+		secretFile,
+		tokensPath,
+		DefaultTokenExchangeURL,
+		"",
+		uploadURL)
+	if err != nil {
+		panic(fmt.Sprintf("NewClient: %v", err))
+	}
+	return client, tokensPath
+}
+
+func TestClient_RunContext(t *testing.T) {
+	var uploads int32
+
+	ts := httptest.NewTLSServer(getRunContextUploadHandler(t, &uploads))
+	defer ts.Close()
+
+	client, tokensPath := mustNewRunContextClient(ts.URL, ts.Client())
+
+	messages := []*transitrealtime.FeedMessage{
+		{Header: &transitrealtime.FeedHeader{GtfsRealtimeVersion: proto.String("2.0")}},
+		{Header: &transitrealtime.FeedHeader{GtfsRealtimeVersion: proto.String("2.0")}},
+	}
+
+	// Provider finishes without an error.
+	err := client.RunContext(
+		context.Background(),
+		providertest.Slice{Messages: messages},
+		"feed.pb",
+		"2483663d-56ce-44cd-a63f-74bb63eb6f24",
+		"93681f64-00a4-471a-998c-24bc9e80eca3")
+	assert.Equal(t, ErrChanClosed, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&uploads))
+
+	// Provider terminates with an error.
+	errTerminal := errors.New("database is gone")
+	err = client.RunContext(
+		context.Background(),
+		providertest.Slice{Messages: messages, Err: errTerminal},
+		"feed.pb",
+		"2483663d-56ce-44cd-a63f-74bb63eb6f24",
+		"93681f64-00a4-471a-998c-24bc9e80eca3")
+	assert.True(t, errors.Is(err, errTerminal))
+	assert.Equal(t, int32(4), atomic.LoadInt32(&uploads))
+
+	// Cancellation.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = client.RunContext(
+		ctx,
+		providertest.Slice{Messages: messages},
+		"feed.pb",
+		"2483663d-56ce-44cd-a63f-74bb63eb6f24",
+		"93681f64-00a4-471a-998c-24bc9e80eca3")
+	assert.Equal(t, context.Canceled, err)
+
+	// Cleanup.
+	removeTokensFile(tokensPath)
+}
+
+// endlessProvider streams empty messages until ctx is done.
+type endlessProvider struct{}
+
+func (endlessProvider) StreamContext(
+	ctx context.Context,
+	feed chan<- *transitrealtime.FeedMessage) error {
+
+	defer close(feed)
+	for {
+		select {
+		case feed <- &transitrealtime.FeedMessage{
+			Header: &transitrealtime.FeedHeader{
+				GtfsRealtimeVersion: proto.String("2.0"),
+			},
+		}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func TestClient_RunContextShutdown(t *testing.T) {
+	n := runtime.NumGoroutine()
+
+	var uploads int32
+	started, release := make(chan struct{}), make(chan struct{})
+
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&uploads, 1) == 1 {
+			close(started)
+		}
+		<-release
+	}))
+
+	tsClient := ts.Client()
+	client, tokensPath := mustNewRunContextClient(ts.URL, tsClient)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() {
+		errc <- client.RunContext(
+			ctx,
+			endlessProvider{},
+			"feed.pb",
+			"2483663d-56ce-44cd-a63f-74bb63eb6f24",
+			"93681f64-00a4-471a-998c-24bc9e80eca3")
+	}()
+
+	<-started
+	cancel()
+	close(release) // The upload in progress is drained...
+	assert.Equal(t, context.Canceled, <-errc)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&uploads)) // ...and no more.
+
+	ts.Close()
+	tsClient.Transport.(*http.Transport).CloseIdleConnections()
+
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > n && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.LessOrEqual(t, runtime.NumGoroutine(), n)
+
+	// Cleanup.
+	removeTokensFile(tokensPath)
+}
+
+func TestWriteTokensToFileAtomic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oauth-test")
+	if err != nil {
+		panic(fmt.Sprintf("TempDir: %v", err))
+	}
+	defer os.RemoveAll(dir)
+
+	tokensPath := filepath.Join(dir, "tokens")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			assert.NoError(t, writeTokensToFile(Tokens{
+				AccessToken:  fmt.Sprint(i),
+				RefreshToken: "2fd78b4d-42b6-440a-b5e8-efc685a52ce7",
+			}, tokensPath))
+		}(i)
+	}
+	wg.Wait()
+
+	// One of the writes has won and no temporary files are left behind.
+	assert.Equal(t, "2fd78b4d-42b6-440a-b5e8-efc685a52ce7", mustLoadCachedTokens(tokensPath).RefreshToken)
+
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		panic(fmt.Sprintf("ReadDir: %v", err))
+	}
+	var names []string
+	for _, fi := range fis {
+		names = append(names, fi.Name())
+	}
+	assert.Equal(t, []string{"tokens", "tokens.lock"}, names)
+}
+
+func TestClient_UploadFeedMessageConcurrent(t *testing.T) {
+	secret := mustLoadClientSecretsJSON()
+
+	var exchanges int32
+	tokensHandler := getUploadFeedMessageTokensHandler(t, secret)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/tokens", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&exchanges, 1)
+		time.Sleep(10 * time.Millisecond) // Let the others pile up.
+		tokensHandler(w, r)
+	})
+	mux.HandleFunc("/upload", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(
+			t,
+			"Bearer ba25ffba-a2b7-4d34-8225-e9477bc94619",
+			r.Header.Get("Authorization"))
+	})
+
+	ts := httptest.NewTLSServer(mux)
+	defer ts.Close()
+
+	secretFile, err := os.Open(filepath.Clean("./testdata/client_secrets.json"))
+	if err != nil {
+		panic(fmt.Sprintf("Open: %v", err))
+	}
+	defer secretFile.Close()
+
+	s := &MemoryTokenStore{}
+	if err := s.Save(Tokens{
+		AccessToken:  "06a99d0d-0f85-4987-bc96-385e39f2f611",
+		TokenType:    "Bearer",
+		RefreshToken: "47452c0f-2d7f-4696-9af3-8c53cec89028",
+	}); err != nil {
+		panic(fmt.Sprintf("Save: %v", err))
+	}
+
+	client, err := NewClient(
+		ts.Client(),
+		secretFile,
+		"",
+		fmt.Sprint(ts.URL, "/tokens"),
+		"",
+		fmt.Sprint(ts.URL, "/upload"),
+		WithTokenStore(s))
+	assert.NoError(t, err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(
+				t,
+				client.UploadFeedMessage(
+					"2483663d-56ce-44cd-a63f-74bb63eb6f24",
+					"93681f64-00a4-471a-998c-24bc9e80eca3",
+					FeedMessageWrapper{
+						Name: "feed.pb",
+						File: bytes.NewReader(nil),
+					}))
+		}()
+	}
+	wg.Wait()
+
+	// Simultaneous refreshes have been coalesced.
+	assert.Equal(t, int32(1), atomic.LoadInt32(&exchanges))
+
+	saved, err := s.Load()
+	assert.NoError(t, err)
+	assert.Equal(t, "ba25ffba-a2b7-4d34-8225-e9477bc94619", saved.AccessToken)
+}
+
+// blockingHandler blocks every request until release is closed and counts
+// them.
+func blockingHandler(requests *int32, release <-chan struct{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(requests, 1)
+		<-release
+	}
+}
+
+func TestNewClientContext(t *testing.T) {
+	var exchanges int32
+	release := make(chan struct{})
+
+	ts := httptest.NewTLSServer(blockingHandler(&exchanges, release))
+	defer ts.Close()
+	defer close(release)
+
+	secretFile := mustLoadClientSecretsFile()
+	defer secretFile.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err := NewClientContext(
+		ctx,
+		ts.Client(),
+		secretFile,
+		"",
+		ts.URL,
+		"7d3c1a9e-52b4-4f0e-8a6d-0c2b9e4f1a3d",
+		DefaultFeedUploadURL,
+		WithTokenStore(&MemoryTokenStore{}))
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&exchanges))
+}
+
+func TestClient_UploadFeedMessageContext(t *testing.T) {
+	var uploads int32
+	release := make(chan struct{})
+
+	ts := httptest.NewTLSServer(blockingHandler(&uploads, release))
+	defer ts.Close()
+	defer close(release)
+
+	client, tokensPath := mustNewRunContextClient(ts.URL, ts.Client())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	err := client.UploadFeedMessageContext(
+		ctx,
+		"2483663d-56ce-44cd-a63f-74bb63eb6f24",
+		"93681f64-00a4-471a-998c-24bc9e80eca3",
+		FeedMessageWrapper{
+			Name: "feed.pb",
+			File: bytes.NewReader([]byte("feed")),
+		})
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&uploads))
+
+	// Cleanup.
+	removeTokensFile(tokensPath)
+}
+
+func TestClient_RunContextCancelExchange(t *testing.T) {
+	var exchanges int32
+	release := make(chan struct{})
+
+	ts := httptest.NewTLSServer(blockingHandler(&exchanges, release))
+	defer ts.Close()
+	defer close(release)
+
+	// Expired, so RunContext starts with a refresh.
+	s := &MemoryTokenStore{}
+	if err := s.Save(Tokens{
+		AccessToken:    "8e2f4a6c-0b1d-4c3e-9f5a-7b9d1e3f5a7c",
+		ExpirationDate: time.Now().Add(-time.Hour),
+		TokenType:      "Bearer",
+		RefreshToken:   "4b6d8f0a-2c4e-4a6b-8d0f-1a3c5e7b9d2f",
+	}); err != nil {
+		panic(fmt.Sprintf("Save: %v", err))
+	}
+
+	secretFile := mustLoadClientSecretsFile()
+	defer secretFile.Close()
+
+	client, err := NewClient(
+		ts.Client(),
+		secretFile,
+		"",
+		ts.URL,
+		"",
+		DefaultFeedUploadURL,
+		WithTokenStore(s),
+		WithRetryPolicy(DefaultRetryPolicy))
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() {
+		errc <- client.RunContext(
+			ctx,
+			idleProvider{},
+			"feed.pb",
+			"2483663d-56ce-44cd-a63f-74bb63eb6f24",
+			"93681f64-00a4-471a-998c-24bc9e80eca3")
+	}()
+
+	for atomic.LoadInt32(&exchanges) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+
+	select {
+	case err := <-errc:
+		assert.Equal(t, context.Canceled, err)
+	case <-time.After(time.Second):
+		t.Fatal("RunContext is stuck in the exchange")
+	}
+}
+
+func TestClient_RunContextUploadTimeout(t *testing.T) {
+	var uploads int32
+	release := make(chan struct{})
+
+	ts := httptest.NewTLSServer(blockingHandler(&uploads, release))
+	defer ts.Close()
+	defer close(release)
+
+	client, tokensPath := mustNewRunContextClient(ts.URL, ts.Client())
+	defer removeTokensFile(tokensPath)
+	WithoutRetry()(client)
+	WithUploadTimeout(500 * time.Millisecond)(client)
+
+	err := client.RunContext(
+		context.Background(),
+		endlessProvider{},
+		"feed.pb",
+		"2483663d-56ce-44cd-a63f-74bb63eb6f24",
+		"93681f64-00a4-471a-998c-24bc9e80eca3")
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&uploads))
+}
+
+func TestClient_UploadFeedMessageContextWaitingForRefresh(t *testing.T) {
+	var exchanges int32
+	release := make(chan struct{})
+
+	ts := httptest.NewTLSServer(blockingHandler(&exchanges, release))
+	defer ts.Close()
+
+	s := &MemoryTokenStore{}
+	if err := s.Save(Tokens{
+		AccessToken:    "8e2f4a6c-0b1d-4c3e-9f5a-7b9d1e3f5a7c",
+		ExpirationDate: time.Now().Add(-time.Hour),
+		TokenType:      "Bearer",
+		RefreshToken:   "4b6d8f0a-2c4e-4a6b-8d0f-1a3c5e7b9d2f",
+	}); err != nil {
+		panic(fmt.Sprintf("Save: %v", err))
+	}
+
+	secretFile := mustLoadClientSecretsFile()
+	defer secretFile.Close()
+
+	client, err := NewClient(
+		ts.Client(),
+		secretFile,
+		"",
+		ts.URL,
+		"",
+		DefaultFeedUploadURL,
+		WithTokenStore(s))
+	assert.NoError(t, err)
+
+	upload := func(ctx context.Context) error {
+		return client.UploadFeedMessageContext(
+			ctx,
+			"2483663d-56ce-44cd-a63f-74bb63eb6f24",
+			"93681f64-00a4-471a-998c-24bc9e80eca3",
+			FeedMessageWrapper{
+				Name: "feed.pb",
+				File: bytes.NewReader([]byte("feed")),
+			})
+	}
+
+	// This one gets stuck in the exchange...
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		upload(context.Background())
+	}()
+	for atomic.LoadInt32(&exchanges) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// ...and this one gives up waiting for it.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	err = upload(ctx)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), err)
+	assert.Less(t, int64(time.Since(start)), int64(time.Second))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&exchanges))
+
+	close(release)
+	<-done
+}
@@ -0,0 +1,161 @@
+package oauth
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+// StatusError is returned when Google responds with an unexpected status.
+type StatusError struct {
+	StatusCode int
+	Status     string
+	Body       []byte
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s: %q", e.Status, e.Body)
+}
+
+// DroppedError is reported (see WithErrorHandler) when RunContext gives up on
+// a message after RetryPolicy's MaxAttempts.
+type DroppedError struct {
+	Attempts int
+	Err      error // The last failure.
+}
+
+func (e *DroppedError) Error() string {
+	return fmt.Sprintf("dropped after %d attempts: %v", e.Attempts, e.Err)
+}
+
+func (e *DroppedError) Unwrap() error {
+	return e.Err
+}
+
+// RetryPolicy decides how RunContext handles failed uploads and token
+// refreshes.
+//
+// Only transient failures are retried: timeouts, failed or broken connections
+// and 408, 429 and 5xx statuses. Other failures (e.g. 400, a malformed URL or
+// an untrusted certificate) are returned right away.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of upload attempts per message. Once
+	// it's reached the message is dropped and RunContext waits for the next
+	// one. If MaxAttempts < 1 the message is retried until it's uploaded (or
+	// replaced, see DropStale).
+	MaxAttempts int
+	// MinBackoff is the delay before the first retry. Consecutive retries of
+	// the same message are delayed twice as long as the previous one, up to
+	// MaxBackoff (if it's positive).
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// Jitter (between 0 and 1) is the fraction of every delay that is
+	// randomized, so that clients failing together don't retry together.
+	Jitter float64
+	// DropStale makes RunContext give up on the failed message as soon as the
+	// provider has sent a newer one and upload the newer one instead.
+	DropStale bool
+}
+
+// DefaultRetryPolicy is the RetryPolicy of Clients created without
+// WithRetryPolicy. It makes up to 6 attempts per message, delayed by 1, 2, 4,
+// 8 and 16 seconds less up to a half for jitter, so a message is dropped 15 to
+// 31 seconds after its first failed attempt.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 6,
+	MinBackoff:  time.Second,
+	MaxBackoff:  30 * time.Second,
+	Jitter:      0.5,
+}
+
+// backoff returns the delay before the given retry (numbered from 1).
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	d := p.MinBackoff
+	for i := 1; i < retry && (p.MaxBackoff <= 0 || d < p.MaxBackoff); i++ {
+		d *= 2
+	}
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	return d - time.Duration(p.Jitter*rand.Float64()*float64(d))
+}
+
+// isRetryable reports whether err is a transient failure.
+func isRetryable(err error) bool {
+	var se *StatusError
+	if errors.As(err, &se) {
+		return se.StatusCode == http.StatusRequestTimeout ||
+			se.StatusCode == http.StatusTooManyRequests ||
+			se.StatusCode >= 500
+	}
+
+	var (
+		unknownAuthority x509.UnknownAuthorityError
+		hostname         x509.HostnameError
+		invalid          x509.CertificateInvalidError
+	)
+	if errors.As(err, &unknownAuthority) ||
+		errors.As(err, &hostname) ||
+		errors.As(err, &invalid) {
+
+		return false // Retrying won't make the certificate trusted.
+	}
+
+	// Every *url.Error is a net.Error, including the ones about malformed URLs
+	// or unsupported schemes, so only what's underneath counts.
+	var (
+		ne net.Error
+		oe *net.OpError
+	)
+	switch {
+	case errors.As(err, &ne) && ne.Timeout():
+		return true
+	case errors.As(err, &oe): // E.g. dial or read failure.
+		return true
+	default: // The connection has been cut.
+		return errors.Is(err, syscall.ECONNRESET) ||
+			errors.Is(err, syscall.ECONNREFUSED) ||
+			errors.Is(err, io.EOF) ||
+			errors.Is(err, io.ErrUnexpectedEOF)
+	}
+}
+
+// Option configures Client.
+type Option func(*Client)
+
+// WithRetryPolicy makes RunContext (and Run) retry transient failures
+// according to p instead of DefaultRetryPolicy.
+func WithRetryPolicy(p RetryPolicy) Option {
+	return func(c *Client) {
+		c.retry = &p
+	}
+}
+
+// WithoutRetry makes RunContext (and Run) return the first error instead of
+// retrying.
+func WithoutRetry() Option {
+	return func(c *Client) {
+		c.retry = nil
+	}
+}
+
+// WithErrorHandler makes RunContext (and Run) call fn with the errors it
+// recovers from instead of returning them: failed token refreshes and uploads
+// that are retried or dropped (see DroppedError). By default they're
+// discarded. fn is called synchronously, so it holds uploads up.
+func WithErrorHandler(fn func(err error)) Option {
+	return func(c *Client) {
+		c.onError = fn
+	}
+}
+
+// retryable reports whether err should be retried by RunContext.
+func (c *Client) retryable(err error) bool {
+	return c.retry != nil && isRetryable(err)
+}
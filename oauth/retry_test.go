@@ -0,0 +1,275 @@
+package oauth
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	transitrealtime "github.com/amwolff/google-gtfs-realtime-tools/gen/go"
+	"github.com/amwolff/google-gtfs-realtime-tools/internal/providertest"
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryPolicy_backoff(t *testing.T) {
+	p := RetryPolicy{MinBackoff: time.Second, MaxBackoff: 5 * time.Second}
+	for i, expected := range []time.Duration{
+		time.Second,
+		2 * time.Second,
+		4 * time.Second,
+		5 * time.Second,
+		5 * time.Second,
+	} {
+		assert.Equal(t, expected, p.backoff(i+1), i+1)
+	}
+
+	p.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		d := p.backoff(2)
+		assert.True(t, d > time.Second && d <= 2*time.Second, d)
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	for _, tt := range []struct {
+		err      error
+		expected bool
+	}{
+		{&StatusError{StatusCode: http.StatusBadGateway}, true},
+		{fmt.Errorf("doExchange: %w", &StatusError{StatusCode: http.StatusServiceUnavailable}), true},
+		{&StatusError{StatusCode: http.StatusTooManyRequests}, true},
+		{&StatusError{StatusCode: http.StatusBadRequest}, false},
+		{&StatusError{StatusCode: http.StatusForbidden}, false},
+		{&url.Error{Op: "Post", Err: &net.OpError{Op: "dial", Err: errors.New("connection refused")}}, true},
+		{&url.Error{Op: "Post", Err: x509.UnknownAuthorityError{}}, false},
+		{&url.Error{Op: "Post", Err: io.ErrUnexpectedEOF}, true},
+		{&url.Error{Op: "Post", Err: syscall.ECONNRESET}, true},
+		{&url.Error{Op: "Post", Err: errors.New(`unsupported protocol scheme "ftp"`)}, false},
+		{&url.Error{Op: "parse", Err: url.InvalidHostError("[")}, false},
+		{errors.New("proto: required field not set"), false},
+	} {
+		assert.Equal(t, tt.expected, isRetryable(tt.err), tt.err)
+	}
+}
+
+// flakyUploadHandler fails uploads of messages whose header timestamp is in
+// failing with status and records timestamps of all upload attempts.
+type flakyUploadHandler struct {
+	mu       sync.Mutex
+	failing  map[uint64]int // Timestamp to the number of failures left.
+	status   int
+	attempts []uint64
+}
+
+func (h *flakyUploadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseMultipartForm(gigabyte); err != nil {
+		panic(fmt.Sprintf("ParseMultipartForm: %v", err))
+	}
+	f, err := r.MultipartForm.File["file"][0].Open()
+	if err != nil {
+		panic(fmt.Sprintf("Open: %v", err))
+	}
+	defer f.Close()
+
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		panic(fmt.Sprintf("ReadAll: %v", err))
+	}
+	var m transitrealtime.FeedMessage
+	if err := proto.Unmarshal(b, &m); err != nil {
+		panic(fmt.Sprintf("Unmarshal: %v", err))
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	ts := m.GetHeader().GetTimestamp()
+	h.attempts = append(h.attempts, ts)
+	if h.failing[ts] != 0 {
+		h.failing[ts]--
+		w.WriteHeader(h.status)
+	}
+}
+
+func newTimestampedMessages(timestamps ...uint64) []*transitrealtime.FeedMessage {
+	var ret []*transitrealtime.FeedMessage
+	for _, ts := range timestamps {
+		ret = append(ret, &transitrealtime.FeedMessage{
+			Header: &transitrealtime.FeedHeader{
+				GtfsRealtimeVersion: proto.String("2.0"),
+				Timestamp:           proto.Uint64(ts),
+			},
+		})
+	}
+	return ret
+}
+
+func TestClient_RunContextRetry(t *testing.T) {
+	policy := RetryPolicy{
+		MaxAttempts: 3,
+		MinBackoff:  time.Millisecond,
+		MaxBackoff:  5 * time.Millisecond,
+		Jitter:      0.5,
+	}
+
+	for _, tt := range []struct {
+		name     string
+		option   Option
+		failing  map[uint64]int
+		status   int
+		attempts []uint64
+		err      error
+	}{
+		{
+			name:     "without retry",
+			option:   WithoutRetry(),
+			failing:  map[uint64]int{1: 1},
+			status:   http.StatusBadGateway,
+			attempts: []uint64{1},
+		},
+		{
+			name:     "transient failure",
+			option:   WithRetryPolicy(policy),
+			failing:  map[uint64]int{1: 2},
+			status:   http.StatusBadGateway,
+			attempts: []uint64{1, 1, 1, 2},
+			err:      ErrChanClosed,
+		},
+		{
+			name:     "max attempts",
+			option:   WithRetryPolicy(policy),
+			failing:  map[uint64]int{1: 5},
+			status:   http.StatusServiceUnavailable,
+			attempts: []uint64{1, 1, 1, 2},
+			err:      ErrChanClosed,
+		},
+		{
+			name:     "fatal failure",
+			option:   WithRetryPolicy(policy),
+			failing:  map[uint64]int{1: 1},
+			status:   http.StatusBadRequest,
+			attempts: []uint64{1},
+		},
+	} {
+		h := &flakyUploadHandler{failing: tt.failing, status: tt.status}
+		ts := httptest.NewTLSServer(h)
+
+		client, tokensPath := mustNewRunContextClient(ts.URL, ts.Client())
+		assert.Equal(t, DefaultRetryPolicy, *client.retry, tt.name)
+		tt.option(client)
+
+		err := client.RunContext(
+			context.Background(),
+			providertest.Slice{Messages: newTimestampedMessages(1, 2)},
+			"feed.pb",
+			"2483663d-56ce-44cd-a63f-74bb63eb6f24",
+			"93681f64-00a4-471a-998c-24bc9e80eca3")
+		if tt.err != nil {
+			assert.Equal(t, tt.err, err, tt.name)
+		} else {
+			var se *StatusError
+			assert.True(t, errors.As(err, &se), tt.name)
+			assert.Equal(t, tt.status, se.StatusCode, tt.name)
+		}
+		assert.Equal(t, tt.attempts, h.attempts, tt.name)
+
+		ts.Close()
+
+		// Cleanup.
+		removeTokensFile(tokensPath)
+	}
+}
+
+func TestClient_RunContextErrorHandler(t *testing.T) {
+	h := &flakyUploadHandler{
+		failing: map[uint64]int{1: 5},
+		status:  http.StatusServiceUnavailable,
+	}
+	ts := httptest.NewTLSServer(h)
+	defer ts.Close()
+
+	client, tokensPath := mustNewRunContextClient(ts.URL, ts.Client())
+	defer removeTokensFile(tokensPath)
+
+	var reported []error
+	WithRetryPolicy(RetryPolicy{MaxAttempts: 3, MinBackoff: time.Millisecond})(client)
+	WithErrorHandler(func(err error) { reported = append(reported, err) })(client)
+
+	err := client.RunContext(
+		context.Background(),
+		providertest.Slice{Messages: newTimestampedMessages(1)},
+		"feed.pb",
+		"2483663d-56ce-44cd-a63f-74bb63eb6f24",
+		"93681f64-00a4-471a-998c-24bc9e80eca3")
+	assert.Equal(t, ErrChanClosed, err)
+
+	// Two retries and then the message is dropped.
+	assert.Len(t, reported, 3)
+	for _, err := range reported {
+		var se *StatusError
+		assert.True(t, errors.As(err, &se), err)
+	}
+	var de *DroppedError
+	assert.True(t, errors.As(reported[2], &de))
+	assert.Equal(t, 3, de.Attempts)
+}
+
+func TestClient_RunContextBadURL(t *testing.T) {
+	client, tokensPath := mustNewRunContextClient("ftp://localhost/upload", http.DefaultClient)
+	defer removeTokensFile(tokensPath)
+	WithRetryPolicy(RetryPolicy{MinBackoff: time.Hour})(client)
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- client.RunContext(
+			context.Background(),
+			providertest.Slice{Messages: newTimestampedMessages(1)},
+			"feed.pb",
+			"2483663d-56ce-44cd-a63f-74bb63eb6f24",
+			"93681f64-00a4-471a-998c-24bc9e80eca3")
+	}()
+
+	select {
+	case err := <-errc:
+		var ue *url.Error
+		assert.True(t, errors.As(err, &ue), err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("bad URL retried")
+	}
+}
+
+func TestClient_RunContextDropStale(t *testing.T) {
+	h := &flakyUploadHandler{
+		failing: map[uint64]int{1: 1000},
+		status:  http.StatusBadGateway,
+	}
+	ts := httptest.NewTLSServer(h)
+	defer ts.Close()
+
+	client, tokensPath := mustNewRunContextClient(ts.URL, ts.Client())
+	WithRetryPolicy(RetryPolicy{MinBackoff: time.Minute, DropStale: true})(client)
+
+	// Message 1 would be retried forever, but message 2 replaces it.
+	err := client.RunContext(
+		context.Background(),
+		providertest.Slice{Messages: newTimestampedMessages(1, 2)},
+		"feed.pb",
+		"2483663d-56ce-44cd-a63f-74bb63eb6f24",
+		"93681f64-00a4-471a-998c-24bc9e80eca3")
+	assert.Equal(t, ErrChanClosed, err)
+	assert.Equal(t, []uint64{1, 2}, h.attempts)
+
+	// Cleanup.
+	removeTokensFile(tokensPath)
+}
@@ -0,0 +1,162 @@
+package oauth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+)
+
+// ErrNoTokens is returned by TokenStore's Load when there are no stored
+// tokens yet.
+var ErrNoTokens = errors.New("no stored tokens")
+
+// TokenStore is the interface that wraps persistence of Client's tokens.
+//
+// Load returns the stored tokens or ErrNoTokens if there are none, in which
+// case NewClient exchanges the authorization code for new ones.
+//
+// Save stores tokens. Client calls it after every exchange.
+type TokenStore interface {
+	Load() (Tokens, error)
+	Save(tokens Tokens) error
+}
+
+// WithTokenStore makes Client load and save its tokens with s instead of the
+// JSON file at tokensCachePath, which can be left empty.
+func WithTokenStore(s TokenStore) Option {
+	return func(c *Client) {
+		c.store = s
+	}
+}
+
+type fileTokenStore struct {
+	path string
+}
+
+// FileTokenStore returns TokenStore that keeps tokens as JSON in the file at
+// path. This is what NewClient uses by default.
+//
+// Saving creates path + ".lock" next to it, which serializes writers, and
+// leaves it there.
+func FileTokenStore(path string) TokenStore {
+	return fileTokenStore{path: path}
+}
+
+func (s fileTokenStore) Load() (Tokens, error) {
+	b, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return Tokens{}, ErrNoTokens
+	}
+	if err != nil {
+		return Tokens{}, fmt.Errorf("ReadFile: %w", err)
+	}
+	var ret Tokens
+	if err := json.Unmarshal(b, &ret); err != nil {
+		return Tokens{}, fmt.Errorf("Unmarshal: %w", err)
+	}
+	return ret, nil
+}
+
+func (s fileTokenStore) Save(tokens Tokens) error {
+	if err := writeTokensToFile(tokens, s.path); err != nil {
+		return fmt.Errorf("writeTokensToFile: %w", err)
+	}
+	return nil
+}
+
+// MemoryTokenStore is a TokenStore that keeps tokens in memory, e.g. for
+// tests. Its zero value is an empty store.
+type MemoryTokenStore struct {
+	mu     sync.Mutex
+	tokens *Tokens
+}
+
+func (s *MemoryTokenStore) Load() (Tokens, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.tokens == nil {
+		return Tokens{}, ErrNoTokens
+	}
+	return *s.tokens, nil
+}
+
+func (s *MemoryTokenStore) Save(tokens Tokens) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.tokens = &tokens
+	return nil
+}
+
+// ReadOnlyTokenStore is a TokenStore that loads tokens from a source Client
+// can't write to, like an environment variable or a secret file mounted into
+// a container, so that several replicas can share credentials. Saved tokens
+// are kept in memory and returned by subsequent Loads.
+//
+// The source holds either tokens as JSON (as written by FileTokenStore) or
+// just the refresh token, in which case the access token is obtained on first
+// use.
+type ReadOnlyTokenStore struct {
+	read  func() (string, error)
+	saved MemoryTokenStore
+}
+
+// EnvTokenStore returns ReadOnlyTokenStore that reads the environment
+// variable name.
+func EnvTokenStore(name string) *ReadOnlyTokenStore {
+	return &ReadOnlyTokenStore{
+		read: func() (string, error) {
+			return os.Getenv(name), nil
+		},
+	}
+}
+
+// SecretFileTokenStore returns ReadOnlyTokenStore that reads the file at path.
+func SecretFileTokenStore(path string) *ReadOnlyTokenStore {
+	return &ReadOnlyTokenStore{
+		read: func() (string, error) {
+			b, err := ioutil.ReadFile(path)
+			if os.IsNotExist(err) {
+				return "", nil
+			}
+			if err != nil {
+				return "", fmt.Errorf("ReadFile: %w", err)
+			}
+			return string(b), nil
+		},
+	}
+}
+
+func (s *ReadOnlyTokenStore) Load() (Tokens, error) {
+	if ret, err := s.saved.Load(); err == nil {
+		return ret, nil
+	}
+
+	v, err := s.read()
+	if err != nil {
+		return Tokens{}, fmt.Errorf("read: %w", err)
+	}
+	v = strings.TrimSpace(v)
+
+	switch {
+	case v == "":
+		return Tokens{}, ErrNoTokens
+	case strings.HasPrefix(v, "{"):
+		var ret Tokens
+		if err := json.Unmarshal([]byte(v), &ret); err != nil {
+			return Tokens{}, fmt.Errorf("Unmarshal: %w", err)
+		}
+		return ret, nil
+	default: // The zero ExpirationDate makes Client refresh right away.
+		return Tokens{RefreshToken: v}, nil
+	}
+}
+
+func (s *ReadOnlyTokenStore) Save(tokens Tokens) error {
+	return s.saved.Save(tokens)
+}
@@ -0,0 +1,150 @@
+package oauth
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenStores(t *testing.T) {
+	tokensPath := filepath.Clean("/tmp/1e0c43a2-8f0e-4a43-9b0c-5e2d2f7f62c1")
+
+	tokens := Tokens{
+		AccessToken:    "5a8b0f6e-1d2c-4b8e-9f3a-7c6d5e4f3a2b",
+		ExpirationDate: time.Date(2020, time.February, 7, 15, 4, 48, 0, time.UTC),
+		TokenType:      "Bearer",
+		RefreshToken:   "c1d2e3f4-a5b6-4c7d-8e9f-0a1b2c3d4e5f",
+	}
+
+	for name, s := range map[string]TokenStore{
+		"file":        FileTokenStore(tokensPath),
+		"memory":      &MemoryTokenStore{},
+		"env":         EnvTokenStore("GTFS_REALTIME_TOOLS_TEST_TOKENS"),
+		"secret file": SecretFileTokenStore(tokensPath),
+	} {
+		_, err := s.Load()
+		assert.True(t, errors.Is(err, ErrNoTokens), name)
+
+		assert.NoError(t, s.Save(tokens), name)
+
+		loaded, err := s.Load()
+		assert.NoError(t, err, name)
+		assert.Equal(t, tokens, loaded, name)
+
+		os.Remove(tokensPath)
+		os.Remove(tokensPath + ".lock")
+	}
+}
+
+func TestReadOnlyTokenStore(t *testing.T) {
+	const name = "GTFS_REALTIME_TOOLS_TEST_TOKENS"
+	defer os.Unsetenv(name)
+
+	tokens := Tokens{
+		AccessToken:    "5a8b0f6e-1d2c-4b8e-9f3a-7c6d5e4f3a2b",
+		ExpirationDate: time.Date(2020, time.February, 7, 15, 4, 48, 0, time.UTC),
+		TokenType:      "Bearer",
+		RefreshToken:   "c1d2e3f4-a5b6-4c7d-8e9f-0a1b2c3d4e5f",
+	}
+	b, err := json.Marshal(tokens)
+	if err != nil {
+		panic(fmt.Sprintf("Marshal: %v", err))
+	}
+
+	os.Setenv(name, string(b))
+	s := EnvTokenStore(name)
+
+	loaded, err := s.Load()
+	assert.NoError(t, err)
+	assert.Equal(t, tokens, loaded)
+
+	// Refreshed tokens outlive the environment.
+	refreshed := tokens
+	refreshed.AccessToken = "0f9e8d7c-6b5a-4c3d-2e1f-0a9b8c7d6e5f"
+	assert.NoError(t, s.Save(refreshed))
+
+	loaded, err = s.Load()
+	assert.NoError(t, err)
+	assert.Equal(t, refreshed, loaded)
+
+	// Only the refresh token.
+	os.Setenv(name, " c1d2e3f4-a5b6-4c7d-8e9f-0a1b2c3d4e5f\n")
+
+	loaded, err = EnvTokenStore(name).Load()
+	assert.NoError(t, err)
+	assert.Equal(t, Tokens{RefreshToken: "c1d2e3f4-a5b6-4c7d-8e9f-0a1b2c3d4e5f"}, loaded)
+
+	os.Setenv(name, "{")
+	_, err = EnvTokenStore(name).Load()
+	assert.Error(t, err)
+}
+
+func TestNewClientWithTokenStore(t *testing.T) {
+	const code = "7d3c1a9e-52b4-4f0e-8a6d-0c2b9e4f1a3d"
+
+	secret := mustLoadClientSecretsJSON()
+
+	ts := httptest.NewTLSServer(getNewClientHandler(t, code, secret))
+	defer ts.Close()
+
+	cs, err := ioutil.ReadFile(filepath.Clean("./testdata/client_secrets.json"))
+	if err != nil {
+		panic(fmt.Sprintf("ReadFile: %v", err))
+	}
+
+	tokens := Tokens{
+		AccessToken:    "9cddb84a-5ab4-4ee4-9abc-cd53183b45bd",
+		ExpirationDate: time.Now().Add(1337 * time.Second),
+		TokenType:      "Bearer",
+		RefreshToken:   "ed93fc15-6ff6-4efc-9c75-faccde6925fe",
+	}
+
+	// Empty store: the authorization code is exchanged and tokens are saved.
+	s := &MemoryTokenStore{}
+	client, err := NewClient(
+		ts.Client(),
+		bytes.NewReader(cs),
+		"",
+		ts.URL,
+		code,
+		DefaultFeedUploadURL,
+		WithTokenStore(s))
+	assert.NoError(t, err)
+	assert.Equal(t, s, client.store)
+
+	saved, err := s.Load()
+	assert.NoError(t, err)
+	checkTokensEquality(t, tokens, saved)
+	checkTokensEquality(t, tokens, client.tokens)
+
+	// Filled store: no exchange (the handler would fail on the empty code).
+	client, err = NewClient(
+		ts.Client(),
+		bytes.NewReader(cs),
+		"",
+		ts.URL,
+		"",
+		DefaultFeedUploadURL,
+		WithTokenStore(s))
+	assert.NoError(t, err)
+	checkTokensEquality(t, tokens, client.tokens)
+
+	// Neither a store nor a path.
+	_, err = NewClient(
+		ts.Client(),
+		bytes.NewReader(cs),
+		"",
+		ts.URL,
+		code,
+		DefaultFeedUploadURL)
+	assert.Error(t, err)
+}
@@ -0,0 +1,221 @@
+// Package broadcast contains implementation of the fan-out of a single
+// provider.FeedProvider to any number of subscribers, which are
+// provider.FeedProviders themselves. This way the same Data Source can be
+// used with both fetch and push models at once.
+package broadcast
+
+import (
+	"context"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	transitrealtime "github.com/amwolff/google-gtfs-realtime-tools/gen/go"
+	"github.com/amwolff/google-gtfs-realtime-tools/provider"
+)
+
+// SlowPolicy decides what happens to a message when a subscriber's buffer is
+// full.
+type SlowPolicy int
+
+const (
+	// DropOldest drops the oldest buffered message to make room for the new
+	// one. Subscribers that can't keep up get the most recent messages.
+	DropOldest SlowPolicy = iota
+	// DropNewest drops the new message.
+	DropNewest
+	// Block makes Broadcaster wait until the subscriber has room, which holds
+	// up the source and therefore every other subscriber too.
+	Block
+)
+
+// Broadcaster streams from a single provider and sends every message to all
+// of its Subscribers.
+//
+// Messages aren't copied: every Subscriber receives the same
+// *transitrealtime.FeedMessage, so consumers must not modify it. Consumers
+// that need to can wrap their Subscriber with middleware.Transform, which
+// works on copies.
+type Broadcaster struct {
+	l *log.Logger
+	p provider.ContextFeedProvider
+
+	mu       sync.Mutex
+	subs     map[*Subscriber]struct{}
+	last     *transitrealtime.FeedMessage
+	finished bool
+	err      error
+}
+
+// NewBroadcaster returns Broadcaster of p. Nothing is streamed until Run is
+// called.
+func NewBroadcaster(p provider.FeedProvider) *Broadcaster {
+	return &Broadcaster{
+		l:    log.New(os.Stdout, "Broadcaster", log.LstdFlags),
+		p:    provider.AdaptLegacy(p),
+		subs: make(map[*Subscriber]struct{}),
+	}
+}
+
+// Subscriber is an implementation of the provider.FeedProvider and
+// provider.ContextFeedProvider that streams messages received by Broadcaster.
+// Subscriber can stream only once; it unsubscribes once its stream ends.
+//
+// Streamed messages are shared with other Subscribers and must be treated as
+// read-only.
+type Subscriber struct {
+	b       *Broadcaster
+	c       chan *transitrealtime.FeedMessage
+	policy  SlowPolicy
+	gone    chan struct{} // Closed on unsubscribe.
+	once    sync.Once
+	dropped uint64
+}
+
+// Subscribe returns a new Subscriber that buffers up to n (at least 1)
+// messages and handles the buffer being full according to policy. The most
+// recent message Broadcaster has received, if any, is buffered right away.
+func (b *Broadcaster) Subscribe(n int, policy SlowPolicy) *Subscriber {
+	if n < 1 {
+		n = 1
+	}
+	ret := &Subscriber{
+		b:      b,
+		c:      make(chan *transitrealtime.FeedMessage, n),
+		policy: policy,
+		gone:   make(chan struct{}),
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.last != nil {
+		ret.c <- b.last
+	}
+	if b.finished {
+		close(ret.c)
+		return ret
+	}
+	b.subs[ret] = struct{}{}
+	return ret
+}
+
+func (s *Subscriber) unsubscribe() {
+	s.once.Do(func() {
+		close(s.gone)
+
+		s.b.mu.Lock()
+		defer s.b.mu.Unlock()
+		delete(s.b.subs, s)
+	})
+}
+
+// Dropped returns the number of messages dropped because the subscriber
+// couldn't keep up.
+func (s *Subscriber) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// send hands m to s according to its policy. It's only called from Run.
+func (s *Subscriber) send(ctx context.Context, m *transitrealtime.FeedMessage) {
+	switch s.policy {
+	case Block:
+		select {
+		case s.c <- m:
+		case <-s.gone:
+		case <-ctx.Done():
+		}
+	case DropNewest:
+		select {
+		case s.c <- m:
+		default:
+			atomic.AddUint64(&s.dropped, 1)
+		}
+	default:
+		for {
+			select {
+			case s.c <- m:
+				return
+			default:
+			}
+			select {
+			case <-s.c:
+				atomic.AddUint64(&s.dropped, 1)
+			default: // The subscriber has just made room.
+			}
+		}
+	}
+}
+
+func (s *Subscriber) Stream(feed chan<- *transitrealtime.FeedMessage) {
+	provider.StreamBackground(s, feed, nil)
+}
+
+// StreamContext streams messages received by Broadcaster until ctx is done or
+// Broadcaster's Run has returned. In the latter case it returns the error Run
+// has returned.
+func (s *Subscriber) StreamContext(
+	ctx context.Context,
+	feed chan<- *transitrealtime.FeedMessage) error {
+
+	defer close(feed)
+	defer s.unsubscribe()
+
+	for {
+		select {
+		case m, ok := <-s.c:
+			if !ok {
+				return s.b.Err()
+			}
+			select {
+			case feed <- m:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Run streams from the provider and sends every message to all Subscribers
+// until ctx is done or the provider stops. It returns the error the provider
+// has returned. Subscribers' streams end once Run returns. Run must be called
+// only once.
+func (b *Broadcaster) Run(ctx context.Context) error {
+	err := provider.Consume(ctx, b.p, func(m *transitrealtime.FeedMessage) {
+		b.mu.Lock()
+		b.last = m
+		subs := make([]*Subscriber, 0, len(b.subs))
+		for s := range b.subs {
+			subs = append(subs, s)
+		}
+		b.mu.Unlock()
+
+		for _, s := range subs {
+			s.send(ctx, m)
+		}
+	})
+	if err != nil {
+		b.l.Printf("Provider stopped: %v", err)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.finished, b.err = true, err
+	for s := range b.subs {
+		close(s.c)
+	}
+	b.subs = nil
+
+	return err
+}
+
+// Err returns the error Run has returned, if it has.
+func (b *Broadcaster) Err() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.err
+}
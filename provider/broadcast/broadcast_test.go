@@ -0,0 +1,136 @@
+package broadcast
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	transitrealtime "github.com/amwolff/google-gtfs-realtime-tools/gen/go"
+	"github.com/amwolff/google-gtfs-realtime-tools/internal/providertest"
+	"github.com/stretchr/testify/assert"
+)
+
+// collect streams s in the background and returns channels delivering
+// timestamps of received messages and the error StreamContext has returned.
+func collect(ctx context.Context, s *Subscriber) (<-chan uint64, <-chan error) {
+	feed := make(chan *transitrealtime.FeedMessage)
+	errc := make(chan error, 1)
+	go func() { errc <- s.StreamContext(ctx, feed) }()
+
+	timestamps := make(chan uint64, 100)
+	go func() {
+		defer close(timestamps)
+		for m := range feed {
+			timestamps <- m.GetHeader().GetTimestamp()
+		}
+	}()
+	return timestamps, errc
+}
+
+func drain(c <-chan uint64) []uint64 {
+	var ret []uint64
+	for t := range c {
+		ret = append(ret, t)
+	}
+	return ret
+}
+
+func TestBroadcaster(t *testing.T) {
+	errSource := errors.New("source failed")
+	p := providertest.NewChan(errSource)
+	b := NewBroadcaster(p)
+
+	fetchTimestamps, fetchErrc := collect(context.Background(), b.Subscribe(1, Block))
+	pushTimestamps, pushErrc := collect(context.Background(), b.Subscribe(1, Block))
+
+	runErrc := make(chan error, 1)
+	go func() { runErrc <- b.Run(context.Background()) }()
+
+	for i := uint64(1); i <= 10; i++ {
+		p.C <- providertest.NewMessage(i)
+		assert.Equal(t, i, <-fetchTimestamps)
+		assert.Equal(t, i, <-pushTimestamps)
+	}
+
+	// Late subscribers get the most recent message right away.
+	late := b.Subscribe(1, Block)
+	lateTimestamps, lateErrc := collect(context.Background(), late)
+	assert.Equal(t, uint64(10), <-lateTimestamps)
+
+	close(p.C)
+
+	assert.Empty(t, drain(fetchTimestamps))
+	assert.Empty(t, drain(pushTimestamps))
+	assert.Empty(t, drain(lateTimestamps))
+	assert.Equal(t, errSource, <-fetchErrc)
+	assert.Equal(t, errSource, <-pushErrc)
+	assert.Equal(t, errSource, <-lateErrc)
+	assert.Equal(t, errSource, <-runErrc)
+	assert.Equal(t, errSource, b.Err())
+
+	// Subscribing after Run has returned still gets the last message.
+	timestamps, errc := collect(context.Background(), b.Subscribe(1, Block))
+	assert.Equal(t, []uint64{10}, drain(timestamps))
+	assert.Equal(t, errSource, <-errc)
+}
+
+func TestBroadcaster_SlowPolicy(t *testing.T) {
+	p := providertest.NewChan(nil)
+	b := NewBroadcaster(p)
+
+	oldest, newest := b.Subscribe(3, DropOldest), b.Subscribe(3, DropNewest)
+
+	runErrc := make(chan error, 1)
+	go func() { runErrc <- b.Run(context.Background()) }()
+
+	// Nobody reads from the subscribers, yet the source isn't held up.
+	for i := uint64(1); i <= 10; i++ {
+		p.C <- providertest.NewMessage(i)
+	}
+	close(p.C)
+	assert.NoError(t, <-runErrc)
+
+	timestamps, errc := collect(context.Background(), oldest)
+	assert.Equal(t, []uint64{8, 9, 10}, drain(timestamps))
+	assert.NoError(t, <-errc)
+	assert.Equal(t, uint64(7), oldest.Dropped())
+
+	timestamps, errc = collect(context.Background(), newest)
+	assert.Equal(t, []uint64{1, 2, 3}, drain(timestamps))
+	assert.NoError(t, <-errc)
+	assert.Equal(t, uint64(7), newest.Dropped())
+}
+
+func TestBroadcaster_Unsubscribe(t *testing.T) {
+	p := providertest.NewChan(nil)
+	b := NewBroadcaster(p)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	blocked, blockedErrc := collect(ctx, b.Subscribe(1, Block))
+	other, otherErrc := collect(context.Background(), b.Subscribe(1, Block))
+
+	runErrc := make(chan error, 1)
+	go func() { runErrc <- b.Run(context.Background()) }()
+
+	p.C <- providertest.NewMessage(1)
+	assert.Equal(t, uint64(1), <-blocked)
+	assert.Equal(t, uint64(1), <-other)
+
+	// Subscribers that go away don't hold up the others.
+	cancel()
+	assert.Equal(t, context.Canceled, <-blockedErrc)
+	drain(blocked)
+
+	for i := uint64(2); i <= 5; i++ {
+		p.C <- providertest.NewMessage(i)
+		assert.Equal(t, i, <-other)
+	}
+	b.mu.Lock()
+	assert.Len(t, b.subs, 1)
+	b.mu.Unlock()
+
+	close(p.C)
+	assert.NoError(t, <-runErrc)
+	assert.Empty(t, drain(other))
+	assert.NoError(t, <-otherErrc)
+}
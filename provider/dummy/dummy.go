@@ -2,6 +2,7 @@
 package dummy
 
 import (
+	"context"
 	"log"
 	"os"
 	"time"
@@ -10,8 +11,9 @@ import (
 	"github.com/golang/protobuf/proto"
 )
 
-// DummyProvider is an example implementation of the provider.FeedProvider that
-// streams example data. It does not close the underlying channel on its own.
+// DummyProvider is an example implementation of the provider.FeedProvider and
+// provider.ContextFeedProvider that streams example data. It does not close
+// the underlying channel on its own.
 type DummyProvider struct {
 	l *log.Logger
 	s chan struct{}
@@ -27,11 +29,21 @@ func NewDummyProvider(d time.Duration) DummyProvider {
 	}
 }
 
+// Close stops streaming.
+//
+// Deprecated: cancel the context passed to StreamContext instead.
 func (d DummyProvider) Close() {
 	d.s <- struct{}{}
 }
 
 func (d DummyProvider) Stream(feed chan<- *transitrealtime.FeedMessage) {
+	d.StreamContext(context.Background(), feed) // It never fails on its own.
+}
+
+func (d DummyProvider) StreamContext(
+	ctx context.Context,
+	feed chan<- *transitrealtime.FeedMessage) error {
+
 	defer close(feed)
 
 	fullDataset := transitrealtime.FeedHeader_FULL_DATASET
@@ -42,12 +54,14 @@ func (d DummyProvider) Stream(feed chan<- *transitrealtime.FeedMessage) {
 	for {
 		select {
 		case <-d.s:
-			return
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
 		default:
 			d.l.Println("Streaming another dummy FeedMessage")
 		}
 		unix := proto.Uint64(uint64(time.Now().Unix()))
-		feed <- &transitrealtime.FeedMessage{
+		m := &transitrealtime.FeedMessage{
 			Header: &transitrealtime.FeedHeader{
 				GtfsRealtimeVersion: proto.String("2.0"),
 				Incrementality:      &fullDataset,
@@ -87,6 +101,19 @@ func (d DummyProvider) Stream(feed chan<- *transitrealtime.FeedMessage) {
 				},
 			},
 		}
-		time.Sleep(d.d)
+		select {
+		case feed <- m:
+		case <-d.s:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		select {
+		case <-time.After(d.d):
+		case <-d.s:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 	}
 }
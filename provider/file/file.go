@@ -0,0 +1,202 @@
+// Package file contains implementation of the provider.FeedProvider that
+// streams feed files written to disk by another system.
+package file
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	transitrealtime "github.com/amwolff/google-gtfs-realtime-tools/gen/go"
+	"github.com/amwolff/google-gtfs-realtime-tools/provider"
+	"github.com/golang/protobuf/proto"
+)
+
+var errNoFiles = errors.New("no feed files in directory")
+
+// textExtensions lists extensions of files in the protocol buffers text
+// format. Files with other extensions are expected to be in the binary
+// format.
+var textExtensions = map[string]bool{
+	".txt":       true,
+	".asciipb":   true,
+	".pbtxt":     true,
+	".prototxt":  true,
+	".textproto": true,
+}
+
+// fileState identifies a version of a file.
+type fileState struct {
+	path    string
+	modTime time.Time
+	size    int64
+}
+
+func (s fileState) equal(o fileState) bool {
+	return s.path == o.path && s.modTime.Equal(o.modTime) && s.size == o.size
+}
+
+// Watcher is an implementation of the provider.FeedProvider and
+// provider.ContextFeedProvider that polls modification time of a file and
+// sends its contents whenever it changes. It doesn't depend on OS-specific
+// file system notifications.
+//
+// If the watched path is a directory, the most recently modified regular file
+// in it is used; hidden files (e.g. temporary files some tools write before
+// renaming) are ignored.
+//
+// Files with .txt, .asciipb, .pbtxt, .prototxt or .textproto extension are
+// decoded as the protocol buffers text format; the rest as the binary format.
+//
+// A file that is still being written could be decoded into an incomplete
+// dataset, so a file is only read after it hasn't changed between two
+// consecutive polls.
+type Watcher struct {
+	l        *log.Logger
+	path     string
+	interval time.Duration
+
+	// Only check touches these.
+	seen fileState
+	sent fileState
+}
+
+// NewWatcher returns Watcher that polls path every interval.
+func NewWatcher(path string, interval time.Duration) *Watcher {
+	return &Watcher{
+		l:        log.New(os.Stdout, "Watcher", log.LstdFlags),
+		path:     path,
+		interval: interval,
+	}
+}
+
+// latest returns the state of the watched file or, if the watched path is a
+// directory, of its most recently modified regular file.
+func (w *Watcher) latest() (fileState, error) {
+	fi, err := os.Stat(w.path)
+	if err != nil {
+		return fileState{}, fmt.Errorf("Stat: %w", err)
+	}
+	if !fi.IsDir() {
+		return fileState{path: w.path, modTime: fi.ModTime(), size: fi.Size()}, nil
+	}
+
+	fis, err := ioutil.ReadDir(w.path)
+	if err != nil {
+		return fileState{}, fmt.Errorf("ReadDir: %w", err)
+	}
+	var ret fileState
+	for _, fi := range fis {
+		if !fi.Mode().IsRegular() || strings.HasPrefix(fi.Name(), ".") {
+			continue
+		}
+		if ret.path == "" || fi.ModTime().After(ret.modTime) {
+			ret = fileState{
+				path:    filepath.Join(w.path, fi.Name()),
+				modTime: fi.ModTime(),
+				size:    fi.Size(),
+			}
+		}
+	}
+	if ret.path == "" {
+		return fileState{}, errNoFiles
+	}
+	return ret, nil
+}
+
+func decode(path string, b []byte) (*transitrealtime.FeedMessage, error) {
+	ret := &transitrealtime.FeedMessage{}
+	if textExtensions[strings.ToLower(filepath.Ext(path))] {
+		if err := proto.UnmarshalText(string(b), ret); err != nil {
+			return nil, fmt.Errorf("UnmarshalText: %w", err)
+		}
+		return ret, nil
+	}
+	if err := proto.Unmarshal(b, ret); err != nil {
+		return nil, fmt.Errorf("Unmarshal: %w", err)
+	}
+	return ret, nil
+}
+
+// check returns the message from the watched file if the file has changed
+// since it was last sent and hasn't changed since the previous check.
+// Otherwise it returns nil.
+func (w *Watcher) check() (*transitrealtime.FeedMessage, error) {
+	s, err := w.latest()
+	if err != nil {
+		return nil, fmt.Errorf("latest: %w", err)
+	}
+	if s.equal(w.sent) {
+		return nil, nil
+	}
+	if !s.equal(w.seen) { // It may still be being written.
+		w.seen = s
+		return nil, nil
+	}
+
+	b, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return nil, fmt.Errorf("ReadFile: %w", err)
+	}
+	if after, err := w.latest(); err != nil || !after.equal(s) {
+		return nil, nil // Changed while it was read; the next check decides.
+	}
+
+	// Broken files are not retried until they change.
+	w.sent = s
+
+	m, err := decode(s.path, b)
+	if err != nil {
+		return nil, fmt.Errorf("decode %s: %w", s.path, err)
+	}
+	return m, nil
+}
+
+func (w *Watcher) Stream(feed chan<- *transitrealtime.FeedMessage) {
+	provider.StreamBackground(w, feed, nil)
+}
+
+// StreamContext polls the watched path until ctx is done. Errors (e.g. the
+// file is missing or cannot be decoded) are logged whenever they change and
+// polling continues.
+func (w *Watcher) StreamContext(
+	ctx context.Context,
+	feed chan<- *transitrealtime.FeedMessage) error {
+
+	defer close(feed)
+
+	t := time.NewTicker(w.interval)
+	defer t.Stop()
+
+	var lastErr string
+	for {
+		m, err := w.check()
+		switch {
+		case err == nil:
+			lastErr = ""
+		case err.Error() != lastErr:
+			w.l.Printf("check: %v", err)
+			lastErr = err.Error()
+		}
+
+		if m != nil {
+			select {
+			case feed <- m:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
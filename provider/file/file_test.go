@@ -0,0 +1,144 @@
+package file
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	transitrealtime "github.com/amwolff/google-gtfs-realtime-tools/gen/go"
+	"github.com/amwolff/google-gtfs-realtime-tools/internal/providertest"
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+)
+
+func marshal(m *transitrealtime.FeedMessage) []byte {
+	b, err := proto.Marshal(m)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// writeFile writes b to path and sets its modification time to the given
+// number of seconds since the epoch.
+func writeFile(path string, b []byte, modTime int64) {
+	if err := ioutil.WriteFile(path, b, 0644); err != nil {
+		panic(err)
+	}
+	t := time.Unix(modTime, 0)
+	if err := os.Chtimes(path, t, t); err != nil {
+		panic(err)
+	}
+}
+
+func tempDir() string {
+	dir, err := ioutil.TempDir("", "file-test")
+	if err != nil {
+		panic(err)
+	}
+	return dir
+}
+
+func TestWatcher_check(t *testing.T) {
+	dir := tempDir()
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "feed.pb")
+
+	w := NewWatcher(path, time.Second)
+
+	_, err := w.check()
+	assert.Error(t, err)
+
+	full := marshal(providertest.NewMessage(1, "1", "2", "3"))
+	writeFile(path, full[:len(full)/2], 1) // Partially written.
+
+	m, err := w.check()
+	assert.NoError(t, err)
+	assert.Nil(t, m)
+
+	writeFile(path, full, 1)
+
+	m, err = w.check()
+	assert.NoError(t, err)
+	assert.Nil(t, m)
+
+	m, err = w.check()
+	assert.NoError(t, err)
+	assert.True(t, proto.Equal(providertest.NewMessage(1, "1", "2", "3"), m))
+
+	// Unchanged file isn't sent again.
+	m, err = w.check()
+	assert.NoError(t, err)
+	assert.Nil(t, m)
+
+	writeFile(path, []byte("garbage"), 2)
+	w.check()
+	_, err = w.check()
+	assert.Error(t, err)
+
+	m, err = w.check()
+	assert.NoError(t, err)
+	assert.Nil(t, m)
+}
+
+func TestWatcher_checkDirectory(t *testing.T) {
+	dir := tempDir()
+	defer os.RemoveAll(dir)
+
+	w := NewWatcher(dir, time.Second)
+
+	_, err := w.check()
+	assert.True(t, errors.Is(err, errNoFiles))
+
+	writeFile(filepath.Join(dir, "1.pb"), marshal(providertest.NewMessage(1)), 1)
+	writeFile(filepath.Join(dir, "2.pbtxt"), []byte(proto.MarshalTextString(providertest.NewMessage(2))), 2)
+	writeFile(filepath.Join(dir, ".3.pb.tmp"), []byte("partial"), 3)
+
+	w.check()
+	m, err := w.check()
+	assert.NoError(t, err)
+	assert.True(t, proto.Equal(providertest.NewMessage(2), m))
+
+	writeFile(filepath.Join(dir, "3.pb"), marshal(providertest.NewMessage(3)), 3)
+
+	w.check()
+	m, err = w.check()
+	assert.NoError(t, err)
+	assert.True(t, proto.Equal(providertest.NewMessage(3), m))
+}
+
+func TestWatcher_checkASCIIPB(t *testing.T) {
+	w := NewWatcher(filepath.Clean("./testdata/trip-updates-full.asciipb"), time.Second)
+
+	w.check()
+	m, err := w.check()
+	assert.NoError(t, err)
+	assert.NotEmpty(t, m.GetEntity())
+}
+
+func TestWatcher_StreamContext(t *testing.T) {
+	dir := tempDir()
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "feed.pb")
+
+	writeFile(path, marshal(providertest.NewMessage(1)), 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	feed := make(chan *transitrealtime.FeedMessage)
+	errc := make(chan error, 1)
+	go func() { errc <- NewWatcher(path, 10*time.Millisecond).StreamContext(ctx, feed) }()
+
+	assert.True(t, proto.Equal(providertest.NewMessage(1), <-feed))
+
+	writeFile(path, marshal(providertest.NewMessage(2)), 2)
+	assert.True(t, proto.Equal(providertest.NewMessage(2), <-feed))
+
+	cancel()
+	for range feed {
+	}
+	assert.Equal(t, context.Canceled, <-errc)
+}
@@ -4,6 +4,7 @@ package historical
 
 import (
 	"compress/gzip"
+	"context"
 	"encoding/csv"
 	"errors"
 	"fmt"
@@ -20,7 +21,7 @@ import (
 )
 
 // HistoricalProvider is an example implementation of the provider.FeedProvider
-// that streams historical data.
+// and provider.ContextFeedProvider that streams historical data.
 type HistoricalProvider struct {
 	l    *log.Logger
 	n    int
@@ -294,6 +295,15 @@ ret:
 }
 
 func (h *HistoricalProvider) Stream(feed chan<- *transitrealtime.FeedMessage) {
+	h.StreamContext(context.Background(), feed) // It never fails on its own.
+}
+
+// StreamContext streams historical data until it has been pushed n times or
+// ctx is done.
+func (h *HistoricalProvider) StreamContext(
+	ctx context.Context,
+	feed chan<- *transitrealtime.FeedMessage) error {
+
 	defer close(feed)
 	for i := 0; i < h.n || h.n < 0; i++ {
 		var prev time.Time
@@ -301,16 +311,24 @@ func (h *HistoricalProvider) Stream(feed chan<- *transitrealtime.FeedMessage) {
 			curr := time.Unix(int64(m.GetHeader().GetTimestamp()), 0)
 
 			h.l.Printf("Serving message with stamp = %v", curr.UTC())
-			feed <- m
+			select {
+			case feed <- m:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
 
 			waitTime := curr.Sub(prev)
 			if waitTime > time.Minute { // Time travel.
-				time.Sleep(time.Minute)
-			} else {
-				time.Sleep(waitTime)
+				waitTime = time.Minute
+			}
+			select {
+			case <-time.After(waitTime):
+			case <-ctx.Done():
+				return ctx.Err()
 			}
 
 			prev = curr
 		}
 	}
+	return nil
 }
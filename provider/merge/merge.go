@@ -0,0 +1,213 @@
+// Package merge contains implementation of the provider.FeedProvider that
+// merges datasets streamed by several provider.FeedProviders into one.
+package merge
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/amwolff/google-gtfs-realtime-tools/diff"
+	transitrealtime "github.com/amwolff/google-gtfs-realtime-tools/gen/go"
+	"github.com/amwolff/google-gtfs-realtime-tools/provider"
+	"github.com/golang/protobuf/proto"
+)
+
+// CollisionPolicy decides what happens to entities of different sources that
+// share an ID (after prefixing).
+type CollisionPolicy int
+
+const (
+	// KeepFirst keeps the entity of the source that comes first.
+	KeepFirst CollisionPolicy = iota
+	// KeepLast keeps the entity of the source that comes last.
+	KeepLast
+	// KeepNewest keeps the entity of the source whose most recent message has
+	// the greatest header timestamp. Ties go to the source that comes first.
+	KeepNewest
+	// Rename keeps every entity, suffixing IDs of the colliding ones with
+	// "-<index of the source>", or the next number that makes them unique.
+	Rename
+)
+
+// Source is one of the providers Merger merges.
+type Source struct {
+	Provider provider.FeedProvider
+	// Prefix, if not empty, is prepended to IDs of the source's entities.
+	Prefix string
+}
+
+// Merger is an implementation of the provider.FeedProvider and
+// provider.ContextFeedProvider that streams all sources concurrently, keeps
+// the most recent dataset of each of them and sends the merged dataset
+// whenever any of them sends a new message.
+//
+// The merged dataset is FULL_DATASET whose header is the header of the source
+// message with the greatest timestamp. Sources can send DIFFERENTIAL messages;
+// they're applied to what the source has sent before.
+type Merger struct {
+	l       *log.Logger
+	sources []Source
+	adapted []provider.ContextFeedProvider
+	policy  CollisionPolicy
+}
+
+// NewMerger returns Merger that merges sources (in the order given) resolving
+// entity ID collisions according to policy.
+func NewMerger(policy CollisionPolicy, sources ...Source) *Merger {
+	ret := &Merger{
+		l:       log.New(os.Stdout, "Merger", log.LstdFlags),
+		sources: sources,
+		policy:  policy,
+	}
+	for _, s := range sources {
+		ret.adapted = append(ret.adapted, provider.AdaptLegacy(s.Provider))
+	}
+	return ret
+}
+
+// withID returns a shallow copy of e with the given ID.
+func withID(e *transitrealtime.FeedEntity, id string) *transitrealtime.FeedEntity {
+	return &transitrealtime.FeedEntity{
+		Id:         proto.String(id),
+		IsDeleted:  e.IsDeleted,
+		TripUpdate: e.TripUpdate,
+		Vehicle:    e.Vehicle,
+		Alert:      e.Alert,
+	}
+}
+
+// merge returns the merged dataset. Sources that haven't sent anything yet
+// have nil datasets.
+func (m *Merger) merge(
+	datasets []*transitrealtime.FeedMessage) *transitrealtime.FeedMessage {
+
+	var (
+		newest   *transitrealtime.FeedMessage
+		entities []*transitrealtime.FeedEntity
+		index    = make(map[string]int) // ID to index in entities.
+		owners   = make(map[string]int) // ID to index of the source it's from.
+	)
+	for i, d := range datasets {
+		if d == nil {
+			continue
+		}
+		if newest == nil ||
+			d.GetHeader().GetTimestamp() > newest.GetHeader().GetTimestamp() {
+
+			newest = d
+		}
+
+		for _, e := range d.GetEntity() {
+			id := m.sources[i].Prefix + e.GetId()
+			if id != e.GetId() {
+				e = withID(e, id)
+			}
+
+			j, ok := index[id]
+			if !ok {
+				index[id], owners[id] = len(entities), i
+				entities = append(entities, e)
+				continue
+			}
+
+			switch m.policy {
+			case KeepLast:
+				entities[j], owners[id] = e, i
+			case KeepNewest:
+				owner := datasets[owners[id]]
+				if d.GetHeader().GetTimestamp() > owner.GetHeader().GetTimestamp() {
+					entities[j], owners[id] = e, i
+				}
+			case Rename:
+				renamed := fmt.Sprintf("%s-%d", id, i)
+				for n := i + 1; ; n++ {
+					if _, ok := index[renamed]; !ok {
+						break
+					}
+					renamed = fmt.Sprintf("%s-%d", id, n)
+				}
+				index[renamed], owners[renamed] = len(entities), i
+				entities = append(entities, withID(e, renamed))
+			}
+		}
+	}
+
+	header := &transitrealtime.FeedHeader{GtfsRealtimeVersion: proto.String("2.0")}
+	if newest.GetHeader() != nil {
+		header = proto.Clone(newest.GetHeader()).(*transitrealtime.FeedHeader)
+	}
+	fullDataset := transitrealtime.FeedHeader_FULL_DATASET
+	header.Incrementality = &fullDataset
+
+	return &transitrealtime.FeedMessage{Header: header, Entity: entities}
+}
+
+type update struct {
+	source  int
+	message *transitrealtime.FeedMessage
+}
+
+func (m *Merger) Stream(feed chan<- *transitrealtime.FeedMessage) {
+	provider.StreamBackground(m, feed, nil)
+}
+
+// StreamContext streams the merged dataset until ctx is done or every source
+// has stopped. Sources that stop don't stop the others; their most recent
+// dataset keeps being merged. If any source has returned an error, the first
+// such error is returned.
+func (m *Merger) StreamContext(
+	ctx context.Context,
+	feed chan<- *transitrealtime.FeedMessage) error {
+
+	defer close(feed)
+
+	updates := make(chan update)
+	errc := make(chan error, len(m.adapted))
+
+	for i, p := range m.adapted {
+		go func(i int, p provider.ContextFeedProvider) {
+			errc <- provider.Consume(ctx, p, func(msg *transitrealtime.FeedMessage) {
+				select {
+				case updates <- update{source: i, message: msg}:
+				case <-ctx.Done():
+				}
+			})
+		}(i, p)
+	}
+
+	var (
+		datasets = make([]*transitrealtime.FeedMessage, len(m.adapted))
+		running  = len(m.adapted)
+		firstErr error
+	)
+	for running > 0 {
+		select {
+		case u := <-updates:
+			d := u.message
+			if d.GetHeader().GetIncrementality() == transitrealtime.FeedHeader_DIFFERENTIAL {
+				d = diff.Apply(datasets[u.source], d)
+			}
+			datasets[u.source] = d
+
+			select {
+			case feed <- m.merge(datasets):
+			case <-ctx.Done():
+			}
+		case err := <-errc:
+			running--
+			if err != nil && ctx.Err() == nil {
+				m.l.Printf("Source stopped: %v", err)
+				if firstErr == nil {
+					firstErr = err
+				}
+			}
+		}
+	}
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return firstErr
+}
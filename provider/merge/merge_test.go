@@ -0,0 +1,128 @@
+package merge
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	transitrealtime "github.com/amwolff/google-gtfs-realtime-tools/gen/go"
+	"github.com/amwolff/google-gtfs-realtime-tools/internal/providertest"
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+)
+
+// entities returns IDs of m's entities along with their timestamps.
+func entities(m *transitrealtime.FeedMessage) map[string]uint64 {
+	ret := make(map[string]uint64)
+	for _, e := range m.GetEntity() {
+		ret[e.GetId()] = e.GetVehicle().GetTimestamp()
+	}
+	return ret
+}
+
+func TestMerger_merge(t *testing.T) {
+	full := transitrealtime.FeedHeader_FULL_DATASET
+
+	datasets := []*transitrealtime.FeedMessage{
+		providertest.NewMessage(2, "a", "b"),
+		nil,
+		providertest.NewMessage(3, "b", "c"),
+		providertest.NewMessage(1, "b"),
+	}
+	sources := []Source{{}, {}, {}, {}}
+
+	for i, tt := range []struct {
+		policy   CollisionPolicy
+		expected map[string]uint64
+	}{
+		{KeepFirst, map[string]uint64{"a": 2, "b": 2, "c": 3}},
+		{KeepLast, map[string]uint64{"a": 2, "b": 1, "c": 3}},
+		{KeepNewest, map[string]uint64{"a": 2, "b": 3, "c": 3}},
+		{Rename, map[string]uint64{"a": 2, "b": 2, "c": 3, "b-2": 3, "b-3": 1}},
+	} {
+		m := NewMerger(tt.policy, sources...).merge(datasets)
+		assert.Equal(t, tt.expected, entities(m), i)
+		assert.Equal(t, uint64(3), m.GetHeader().GetTimestamp(), i)
+		assert.Equal(t, full, m.GetHeader().GetIncrementality(), i)
+	}
+
+	// Prefixes make IDs unique.
+	sources = []Source{{Prefix: "x:"}, {}, {Prefix: "y:"}, {Prefix: "z:"}}
+	m := NewMerger(KeepFirst, sources...).merge(datasets)
+	assert.Equal(t, map[string]uint64{
+		"x:a": 2, "x:b": 2, "y:b": 3, "y:c": 3, "z:b": 1,
+	}, entities(m))
+	assert.Equal(t, "b", datasets[0].Entity[1].GetId()) // Not modified.
+}
+
+func TestMerger_mergeRenameUnique(t *testing.T) {
+	datasets := []*transitrealtime.FeedMessage{
+		providertest.NewMessage(1, "a", "a-1", "b", "b"),
+		providertest.NewMessage(1, "a", "b"),
+		providertest.NewMessage(1, "a-1"),
+	}
+	m := NewMerger(Rename, Source{}, Source{}, Source{}).merge(datasets)
+
+	expected := []string{"a", "a-1", "b", "b-0", "a-2", "b-1", "a-1-2"}
+	assert.Equal(t, expected, providertest.EntityIDs(m))
+}
+
+func TestMerger_StreamContext(t *testing.T) {
+	full := transitrealtime.FeedHeader_FULL_DATASET
+
+	errAVL := errors.New("AVL is down")
+	avl, cms := providertest.NewChan(errAVL), providertest.NewChan(nil)
+
+	m := NewMerger(
+		KeepFirst,
+		Source{Provider: avl, Prefix: "avl:"},
+		Source{Provider: cms, Prefix: "cms:"})
+
+	feed := make(chan *transitrealtime.FeedMessage)
+	errc := make(chan error, 1)
+	go func() { errc <- m.StreamContext(context.Background(), feed) }()
+
+	avl.C <- providertest.NewMessage(10, "1", "2")
+	assert.Equal(t, map[string]uint64{"avl:1": 10, "avl:2": 10}, entities(<-feed))
+
+	cms.C <- providertest.NewMessage(5, "1")
+	merged := <-feed
+	assert.Equal(t, map[string]uint64{"avl:1": 10, "avl:2": 10, "cms:1": 5}, entities(merged))
+	assert.Equal(t, uint64(10), merged.GetHeader().GetTimestamp())
+
+	// Sources that stop keep being merged.
+	close(avl.C)
+
+	d := providertest.NewDifferential(11, "2")
+	d.Entity = append(d.Entity, &transitrealtime.FeedEntity{
+		Id:        proto.String("1"),
+		IsDeleted: proto.Bool(true),
+	})
+	cms.C <- d
+	merged = <-feed
+	assert.Equal(t, map[string]uint64{"avl:1": 10, "avl:2": 10, "cms:2": 11}, entities(merged))
+	assert.Equal(t, uint64(11), merged.GetHeader().GetTimestamp())
+	assert.Equal(t, full, merged.GetHeader().GetIncrementality())
+
+	close(cms.C)
+	for range feed {
+	}
+	assert.Equal(t, errAVL, <-errc)
+}
+
+func TestMerger_StreamContextCancel(t *testing.T) {
+	a, b := providertest.NewChan(nil), providertest.NewChan(nil)
+	m := NewMerger(KeepFirst, Source{Provider: a}, Source{Provider: b})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	feed := make(chan *transitrealtime.FeedMessage)
+	errc := make(chan error, 1)
+	go func() { errc <- m.StreamContext(ctx, feed) }()
+
+	a.C <- providertest.NewMessage(1, "1")
+	cancel() // Without receiving the merged dataset.
+
+	for range feed {
+	}
+	assert.Equal(t, context.Canceled, <-errc)
+}
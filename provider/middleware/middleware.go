@@ -0,0 +1,70 @@
+// Package middleware contains provider.FeedProvider wrappers that transform
+// streamed messages (e.g. drop entities or strip sensitive fields) before they
+// reach the consumer.
+package middleware
+
+import (
+	"context"
+
+	transitrealtime "github.com/amwolff/google-gtfs-realtime-tools/gen/go"
+	"github.com/amwolff/google-gtfs-realtime-tools/provider"
+	"github.com/golang/protobuf/proto"
+)
+
+// Middleware wraps provider.FeedProvider into another one.
+type Middleware func(provider.FeedProvider) provider.FeedProvider
+
+// Chain returns p wrapped with mws so that messages pass through them in the
+// order given.
+func Chain(p provider.FeedProvider, mws ...Middleware) provider.FeedProvider {
+	for _, mw := range mws {
+		p = mw(p)
+	}
+	return p
+}
+
+// Func modifies m in place.
+type Func func(m *transitrealtime.FeedMessage)
+
+// Transform returns Middleware that applies fns (in the order given) to a copy
+// of every message. Messages sent by the wrapped provider are never modified,
+// so they can be shared with other consumers.
+func Transform(fns ...Func) Middleware {
+	return func(p provider.FeedProvider) provider.FeedProvider {
+		return &transformer{
+			p:   provider.AdaptLegacy(p),
+			fns: fns,
+		}
+	}
+}
+
+// transformer is an implementation of the provider.FeedProvider and
+// provider.ContextFeedProvider returned by Transform.
+type transformer struct {
+	p   provider.ContextFeedProvider
+	fns []Func
+}
+
+func (t *transformer) Stream(feed chan<- *transitrealtime.FeedMessage) {
+	provider.StreamBackground(t, feed, nil)
+}
+
+// StreamContext streams transformed messages of the wrapped provider until it
+// stops and returns the error it has returned.
+func (t *transformer) StreamContext(
+	ctx context.Context,
+	feed chan<- *transitrealtime.FeedMessage) error {
+
+	defer close(feed)
+
+	return provider.Consume(ctx, t.p, func(m *transitrealtime.FeedMessage) {
+		m = proto.Clone(m).(*transitrealtime.FeedMessage)
+		for _, fn := range t.fns {
+			fn(m)
+		}
+		select {
+		case feed <- m:
+		case <-ctx.Done():
+		}
+	})
+}
@@ -0,0 +1,271 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/amwolff/google-gtfs-realtime-tools/filter"
+	transitrealtime "github.com/amwolff/google-gtfs-realtime-tools/gen/go"
+	"github.com/amwolff/google-gtfs-realtime-tools/internal/providertest"
+	"github.com/amwolff/google-gtfs-realtime-tools/provider"
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+)
+
+func newVehicle(id, routeID string, lat, lon float32) *transitrealtime.FeedEntity {
+	return &transitrealtime.FeedEntity{
+		Id: proto.String(id),
+		Vehicle: &transitrealtime.VehiclePosition{
+			Trip: &transitrealtime.TripDescriptor{RouteId: proto.String(routeID)},
+			Vehicle: &transitrealtime.VehicleDescriptor{
+				Id:           proto.String(id),
+				LicensePlate: proto.String("WI 12345"),
+			},
+			Position: &transitrealtime.Position{
+				Latitude:  proto.Float32(lat),
+				Longitude: proto.Float32(lon),
+			},
+		},
+	}
+}
+
+func newMessage(entities ...*transitrealtime.FeedEntity) *transitrealtime.FeedMessage {
+	return &transitrealtime.FeedMessage{
+		Header: &transitrealtime.FeedHeader{
+			GtfsRealtimeVersion: proto.String("2.0"),
+			Timestamp:           proto.Uint64(1),
+		},
+		Entity: entities,
+	}
+}
+
+func TestChain(t *testing.T) {
+	errSource := errors.New("source failed")
+	p := providertest.NewChan(errSource)
+
+	flt := filter.Filter{RouteIDs: []string{"4"}}
+	prefix := RewriteIDs(EntityIDs, func(id string) string { return "x:" + id })
+
+	// Filtering before rewriting sees the original IDs and vice versa.
+	chained := Chain(
+		p,
+		Transform(FilterEntities(func(e *transitrealtime.FeedEntity) bool {
+			return e.GetId() != "2"
+		})),
+		Transform(prefix, FilterEntities(flt.Match), StripLicensePlates()),
+		Transform(FilterEntities(func(e *transitrealtime.FeedEntity) bool {
+			return e.GetId() != "x:3"
+		})))
+
+	feed := make(chan *transitrealtime.FeedMessage)
+	errc := make(chan error, 1)
+	go func() { errc <- provider.AdaptLegacy(chained).StreamContext(context.Background(), feed) }()
+
+	m := newMessage(
+		newVehicle("1", "4", 0, 0),
+		newVehicle("2", "4", 0, 0),
+		newVehicle("3", "4", 0, 0),
+		newVehicle("4", "11", 0, 0))
+	p.C <- m
+
+	got := <-feed
+	assert.Equal(t, []string{"x:1"}, providertest.EntityIDs(got))
+	assert.Nil(t, got.Entity[0].Vehicle.Vehicle.LicensePlate)
+
+	// The provider's message isn't modified.
+	assert.Equal(t, []string{"1", "2", "3", "4"}, providertest.EntityIDs(m))
+	assert.Equal(t, "WI 12345", m.Entity[0].Vehicle.Vehicle.GetLicensePlate())
+
+	close(p.C)
+	for range feed {
+	}
+	assert.Equal(t, errSource, <-errc)
+}
+
+func TestChain_Cancel(t *testing.T) {
+	p := providertest.NewChan(nil)
+	chained := Chain(p, Transform(StripLicensePlates()), Transform(RoundCoordinates(2)))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	feed := make(chan *transitrealtime.FeedMessage)
+	errc := make(chan error, 1)
+	go func() { errc <- provider.AdaptLegacy(chained).StreamContext(ctx, feed) }()
+
+	p.C <- newMessage()
+	cancel() // Without receiving the message.
+
+	for range feed {
+	}
+	assert.Equal(t, context.Canceled, <-errc)
+}
+
+func TestRewriteIDs(t *testing.T) {
+	newEntity := func() *transitrealtime.FeedEntity {
+		return &transitrealtime.FeedEntity{
+			Id: proto.String("e"),
+			TripUpdate: &transitrealtime.TripUpdate{
+				Trip: &transitrealtime.TripDescriptor{
+					TripId:  proto.String("t"),
+					RouteId: proto.String("r"),
+				},
+				Vehicle: &transitrealtime.VehicleDescriptor{Id: proto.String("v")},
+				StopTimeUpdate: []*transitrealtime.TripUpdate_StopTimeUpdate{
+					{StopId: proto.String("s")},
+					{StopSequence: proto.Uint32(2)},
+				},
+			},
+			Alert: &transitrealtime.Alert{
+				InformedEntity: []*transitrealtime.EntitySelector{
+					{RouteId: proto.String("r"), StopId: proto.String("s")},
+				},
+			},
+		}
+	}
+	upper := strings.ToUpper
+
+	for _, tt := range []struct {
+		kind     IDKind
+		expected func(e *transitrealtime.FeedEntity)
+	}{
+		{EntityIDs, func(e *transitrealtime.FeedEntity) {
+			e.Id = proto.String("E")
+		}},
+		{TripIDs, func(e *transitrealtime.FeedEntity) {
+			e.TripUpdate.Trip.TripId = proto.String("T")
+		}},
+		{RouteIDs, func(e *transitrealtime.FeedEntity) {
+			e.TripUpdate.Trip.RouteId = proto.String("R")
+			e.Alert.InformedEntity[0].RouteId = proto.String("R")
+		}},
+		{StopIDs, func(e *transitrealtime.FeedEntity) {
+			e.TripUpdate.StopTimeUpdate[0].StopId = proto.String("S")
+			e.Alert.InformedEntity[0].StopId = proto.String("S")
+		}},
+		{VehicleIDs, func(e *transitrealtime.FeedEntity) {
+			e.TripUpdate.Vehicle.Id = proto.String("V")
+		}},
+	} {
+		m := newMessage(newEntity())
+		RewriteIDs(tt.kind, upper)(m)
+
+		expected := newEntity()
+		tt.expected(expected)
+		assert.True(t, proto.Equal(expected, m.Entity[0]), tt.kind)
+	}
+}
+
+func TestStripFields(t *testing.T) {
+	strip, err := StripFields(
+		"vehicle.position.speed",
+		"trip_update.stop_time_update.arrival.uncertainty",
+		"alert")
+	if err != nil {
+		panic(err)
+	}
+
+	m := newMessage(
+		&transitrealtime.FeedEntity{
+			Id: proto.String("1"),
+			Vehicle: &transitrealtime.VehiclePosition{
+				Position: &transitrealtime.Position{
+					Latitude:  proto.Float32(1),
+					Longitude: proto.Float32(2),
+					Speed:     proto.Float32(3),
+				},
+			},
+			Alert: &transitrealtime.Alert{},
+		},
+		&transitrealtime.FeedEntity{
+			Id: proto.String("2"),
+			TripUpdate: &transitrealtime.TripUpdate{
+				StopTimeUpdate: []*transitrealtime.TripUpdate_StopTimeUpdate{
+					{Arrival: &transitrealtime.TripUpdate_StopTimeEvent{
+						Delay:       proto.Int32(5),
+						Uncertainty: proto.Int32(60),
+					}},
+					{Departure: &transitrealtime.TripUpdate_StopTimeEvent{
+						Uncertainty: proto.Int32(60),
+					}},
+				},
+			},
+		})
+	strip(m)
+
+	pos := m.Entity[0].Vehicle.Position
+	assert.Nil(t, pos.Speed)
+	assert.Equal(t, float32(1), pos.GetLatitude())
+	assert.Nil(t, m.Entity[0].Alert)
+
+	updates := m.Entity[1].TripUpdate.StopTimeUpdate
+	assert.Nil(t, updates[0].Arrival.Uncertainty)
+	assert.Equal(t, int32(5), updates[0].Arrival.GetDelay())
+	assert.Equal(t, int32(60), updates[1].Departure.GetUncertainty())
+
+	for _, path := range []string{
+		"vehicle.plate",
+		"vehicle.timestamp.seconds",
+		"vehicle.position.latitude",
+		"",
+	} {
+		_, err := StripFields(path)
+		assert.Error(t, err, path)
+	}
+}
+
+func TestNormalizeTimestamps(t *testing.T) {
+	normalize := normalizeTimestamps(func() time.Time { return time.Unix(1000, 0) })
+
+	m := newMessage(&transitrealtime.FeedEntity{
+		Id: proto.String("1"),
+		Vehicle: &transitrealtime.VehiclePosition{
+			Timestamp: proto.Uint64(1582000000123),
+		},
+		TripUpdate: &transitrealtime.TripUpdate{
+			Timestamp: proto.Uint64(1581999999),
+			StopTimeUpdate: []*transitrealtime.TripUpdate_StopTimeUpdate{
+				{Arrival: &transitrealtime.TripUpdate_StopTimeEvent{
+					Time: proto.Int64(1582000600000),
+				}},
+			},
+		},
+	})
+	m.Header.Timestamp = proto.Uint64(1582000000000)
+	normalize(m)
+
+	assert.Equal(t, uint64(1582000000), m.GetHeader().GetTimestamp())
+	assert.Equal(t, uint64(1582000000), m.Entity[0].Vehicle.GetTimestamp())
+	assert.Equal(t, uint64(1581999999), m.Entity[0].TripUpdate.GetTimestamp())
+	assert.Equal(t, int64(1582000600), m.Entity[0].TripUpdate.StopTimeUpdate[0].Arrival.GetTime())
+
+	// Vehicles can't be ahead of the feed.
+	m = newMessage(&transitrealtime.FeedEntity{
+		Id:      proto.String("1"),
+		Vehicle: &transitrealtime.VehiclePosition{Timestamp: proto.Uint64(2000)},
+	})
+	m.Header.Timestamp = nil
+	normalize(m)
+
+	assert.Equal(t, uint64(1000), m.GetHeader().GetTimestamp())
+	assert.Equal(t, uint64(1000), m.Entity[0].Vehicle.GetTimestamp())
+
+	m = &transitrealtime.FeedMessage{}
+	normalize(m)
+	assert.Equal(t, "2.0", m.GetHeader().GetGtfsRealtimeVersion())
+	assert.Equal(t, uint64(1000), m.GetHeader().GetTimestamp())
+}
+
+func TestRoundCoordinates(t *testing.T) {
+	m := newMessage(
+		newVehicle("1", "4", 47.376887, 8.541694),
+		newVehicle("2", "4", -33.868820, 151.209296),
+		&transitrealtime.FeedEntity{Id: proto.String("3"), Alert: &transitrealtime.Alert{}})
+	RoundCoordinates(3)(m)
+
+	assert.Equal(t, float32(47.377), m.Entity[0].Vehicle.Position.GetLatitude())
+	assert.Equal(t, float32(8.542), m.Entity[0].Vehicle.Position.GetLongitude())
+	assert.Equal(t, float32(-33.869), m.Entity[1].Vehicle.Position.GetLatitude())
+	assert.Equal(t, float32(151.209), m.Entity[1].Vehicle.Position.GetLongitude())
+}
@@ -0,0 +1,286 @@
+package middleware
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"time"
+
+	transitrealtime "github.com/amwolff/google-gtfs-realtime-tools/gen/go"
+	"github.com/golang/protobuf/proto"
+)
+
+// FilterEntities returns Func that drops entities for which keep returns
+// false. filter.Filter's Match method can be used as keep.
+func FilterEntities(keep func(e *transitrealtime.FeedEntity) bool) Func {
+	return func(m *transitrealtime.FeedMessage) {
+		var kept []*transitrealtime.FeedEntity
+		for _, e := range m.Entity {
+			if keep(e) {
+				kept = append(kept, e)
+			}
+		}
+		m.Entity = kept
+	}
+}
+
+// IDKind selects IDs RewriteIDs rewrites.
+type IDKind int
+
+const (
+	// EntityIDs are IDs of the entities.
+	EntityIDs IDKind = iota
+	// TripIDs are trip_id fields of trip descriptors.
+	TripIDs
+	// RouteIDs are route_id fields of trip descriptors and entity selectors.
+	RouteIDs
+	// StopIDs are stop_id fields of vehicle positions, stop time updates and
+	// entity selectors.
+	StopIDs
+	// VehicleIDs are id fields of vehicle descriptors.
+	VehicleIDs
+)
+
+// RewriteIDs returns Func that replaces every ID of the given kind with what
+// fn returns for it. Unset IDs are left alone.
+func RewriteIDs(kind IDKind, fn func(id string) string) Func {
+	rewrite := func(id *string) *string {
+		if id == nil {
+			return nil
+		}
+		return proto.String(fn(*id))
+	}
+	rewriteTrip := func(t *transitrealtime.TripDescriptor) {
+		if t == nil {
+			return
+		}
+		switch kind {
+		case TripIDs:
+			t.TripId = rewrite(t.TripId)
+		case RouteIDs:
+			t.RouteId = rewrite(t.RouteId)
+		}
+	}
+	rewriteVehicle := func(v *transitrealtime.VehicleDescriptor) {
+		if v != nil && kind == VehicleIDs {
+			v.Id = rewrite(v.Id)
+		}
+	}
+
+	return func(m *transitrealtime.FeedMessage) {
+		for _, e := range m.Entity {
+			if kind == EntityIDs {
+				e.Id = rewrite(e.Id)
+			}
+			if v := e.Vehicle; v != nil {
+				rewriteTrip(v.Trip)
+				rewriteVehicle(v.Vehicle)
+				if kind == StopIDs {
+					v.StopId = rewrite(v.StopId)
+				}
+			}
+			if u := e.TripUpdate; u != nil {
+				rewriteTrip(u.Trip)
+				rewriteVehicle(u.Vehicle)
+				for _, s := range u.StopTimeUpdate {
+					if kind == StopIDs {
+						s.StopId = rewrite(s.StopId)
+					}
+				}
+			}
+			if a := e.Alert; a != nil {
+				for _, s := range a.InformedEntity {
+					rewriteTrip(s.Trip)
+					switch kind {
+					case RouteIDs:
+						s.RouteId = rewrite(s.RouteId)
+					case StopIDs:
+						s.StopId = rewrite(s.StopId)
+					}
+				}
+			}
+		}
+	}
+}
+
+// protoField returns index of the field of struct type t that is named name in
+// gtfs-realtime.proto and whether the field is required.
+func protoField(t reflect.Type, name string) (index int, required bool, ok bool) {
+	for i := 0; i < t.NumField(); i++ {
+		opts := strings.Split(t.Field(i).Tag.Get("protobuf"), ",")
+		for _, o := range opts {
+			if o == "name="+name {
+				return i, len(opts) > 2 && opts[2] == "req", true
+			}
+		}
+	}
+	return 0, false, false
+}
+
+// fieldPath returns indexes of the struct fields named by the dot-separated
+// path, starting at FeedEntity.
+func fieldPath(path string) ([]int, error) {
+	var (
+		ret []int
+		t   = reflect.TypeOf(transitrealtime.FeedEntity{})
+	)
+	for _, name := range strings.Split(path, ".") {
+		for t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice {
+			t = t.Elem()
+		}
+		if t.Kind() != reflect.Struct {
+			return nil, fmt.Errorf("%s: %s is not a message", path, t)
+		}
+		i, required, ok := protoField(t, name)
+		if !ok {
+			return nil, fmt.Errorf("%s: %s has no field %s", path, t.Name(), name)
+		}
+		if required {
+			return nil, fmt.Errorf("%s: %s.%s is required", path, t.Name(), name)
+		}
+		ret = append(ret, i)
+		t = t.Field(i).Type
+	}
+	return ret, nil
+}
+
+// clearField zeroes the field at index in v, descending into every element of
+// repeated fields.
+func clearField(v reflect.Value, index []int) {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if !v.IsNil() {
+			clearField(v.Elem(), index)
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			clearField(v.Index(i), index)
+		}
+	case reflect.Struct:
+		f := v.Field(index[0])
+		if len(index) == 1 {
+			f.Set(reflect.Zero(f.Type()))
+			return
+		}
+		clearField(f, index[1:])
+	}
+}
+
+// StripFields returns Func that clears the fields of every entity at paths.
+// Paths are dot-separated field names as in gtfs-realtime.proto relative to
+// FeedEntity, e.g. "vehicle.vehicle.license_plate" or
+// "trip_update.stop_time_update.arrival.uncertainty". Required fields cannot be
+// stripped.
+func StripFields(paths ...string) (Func, error) {
+	var indexes [][]int
+	for _, p := range paths {
+		index, err := fieldPath(p)
+		if err != nil {
+			return nil, fmt.Errorf("fieldPath: %w", err)
+		}
+		indexes = append(indexes, index)
+	}
+
+	return func(m *transitrealtime.FeedMessage) {
+		for _, e := range m.Entity {
+			for _, index := range indexes {
+				clearField(reflect.ValueOf(e), index)
+			}
+		}
+	}, nil
+}
+
+// StripLicensePlates returns Func that clears license plates of all vehicles.
+func StripLicensePlates() Func {
+	ret, err := StripFields(
+		"vehicle.vehicle.license_plate",
+		"trip_update.vehicle.license_plate")
+	if err != nil {
+		panic(err)
+	}
+	return ret
+}
+
+// maxSeconds is the first timestamp (in 5138) that is considered to be in
+// milliseconds.
+const maxSeconds = 1e11
+
+func seconds(t uint64) uint64 {
+	if t >= maxSeconds {
+		return t / 1000
+	}
+	return t
+}
+
+// NormalizeTimestamps returns Func that fixes common timestamp mistakes:
+// timestamps in milliseconds are converted to seconds, a missing header
+// timestamp is set to the current time and vehicle and trip update timestamps
+// later than the header's are set to it.
+func NormalizeTimestamps() Func {
+	return normalizeTimestamps(time.Now)
+}
+
+func normalizeTimestamps(now func() time.Time) Func {
+	normalize := func(t *uint64, header uint64) *uint64 {
+		if t == nil {
+			return nil
+		}
+		ret := seconds(*t)
+		if ret > header {
+			ret = header
+		}
+		return &ret
+	}
+	normalizeEvent := func(e *transitrealtime.TripUpdate_StopTimeEvent) {
+		if e != nil && e.GetTime() >= maxSeconds {
+			e.Time = proto.Int64(e.GetTime() / 1000)
+		}
+	}
+
+	return func(m *transitrealtime.FeedMessage) {
+		if m.Header == nil {
+			m.Header = &transitrealtime.FeedHeader{
+				GtfsRealtimeVersion: proto.String("2.0"),
+			}
+		}
+		header := seconds(m.Header.GetTimestamp())
+		if header == 0 {
+			header = uint64(now().Unix())
+		}
+		m.Header.Timestamp = &header
+
+		for _, e := range m.Entity {
+			if v := e.Vehicle; v != nil {
+				v.Timestamp = normalize(v.Timestamp, header)
+			}
+			if u := e.TripUpdate; u != nil {
+				u.Timestamp = normalize(u.Timestamp, header)
+				for _, s := range u.StopTimeUpdate {
+					normalizeEvent(s.Arrival)
+					normalizeEvent(s.Departure)
+				}
+			}
+		}
+	}
+}
+
+// RoundCoordinates returns Func that rounds latitudes and longitudes of
+// vehicle positions to the given number of decimal places.
+func RoundCoordinates(decimals int) Func {
+	p := math.Pow10(decimals)
+	round := func(x *float32) *float32 {
+		if x == nil {
+			return nil
+		}
+		return proto.Float32(float32(math.Round(float64(*x)*p) / p))
+	}
+
+	return func(m *transitrealtime.FeedMessage) {
+		for _, e := range m.Entity {
+			if pos := e.GetVehicle().GetPosition(); pos != nil {
+				pos.Latitude, pos.Longitude = round(pos.Latitude), round(pos.Longitude)
+			}
+		}
+	}
+}
@@ -2,7 +2,11 @@
 // communication with the Google Transit APIs.
 package provider
 
-import transitrealtime "github.com/amwolff/google-gtfs-realtime-tools/gen/go"
+import (
+	"context"
+
+	transitrealtime "github.com/amwolff/google-gtfs-realtime-tools/gen/go"
+)
 
 // FeedProvider is the interface that wraps feed messages streaming.
 //
@@ -16,6 +20,140 @@ import transitrealtime "github.com/amwolff/google-gtfs-realtime-tools/gen/go"
 // Callers will typically concurrently call Stream only once.
 //
 // Implementations must close feed when they are done.
+//
+// New implementations should prefer ContextFeedProvider.
 type FeedProvider interface {
 	Stream(feed chan<- *transitrealtime.FeedMessage)
 }
+
+// ContextFeedProvider is the interface that wraps cancellable feed messages
+// streaming.
+//
+// StreamContext starts streaming GTFS-realtime dataset onto feed until ctx is
+// done or streaming cannot continue. It returns ctx.Err() in the former case
+// and the error that made streaming impossible in the latter. A nil error means
+// that there is nothing more to stream (e.g. finite dataset has been
+// exhausted).
+//
+// Errors should not be included in the message. Implementations are still
+// encouraged to handle transient errors on their own and only return errors
+// they cannot recover from.
+//
+// Implementations must not block on sending to feed once ctx is done and must
+// close feed before they return.
+type ContextFeedProvider interface {
+	StreamContext(
+		ctx context.Context,
+		feed chan<- *transitrealtime.FeedMessage) error
+}
+
+// Consume streams from p until it closes its channel, calling fn with every
+// message, and returns the error p has returned.
+//
+// Once ctx is done p stops as well, so fn should drop messages rather than
+// block on anything that's bound to ctx.
+func Consume(
+	ctx context.Context,
+	p ContextFeedProvider,
+	fn func(m *transitrealtime.FeedMessage)) error {
+
+	feed := make(chan *transitrealtime.FeedMessage)
+	errc := make(chan error, 1)
+
+	go func() { errc <- p.StreamContext(ctx, feed) }()
+
+	for m := range feed {
+		fn(m)
+	}
+
+	return <-errc
+}
+
+// StreamBackground streams from p using context.Background() and calls
+// onError with the error p has returned, if any (and if onError isn't nil).
+// ContextFeedProvider implementations that report errors some other way can
+// use it to implement FeedProvider as well:
+//
+//	func (x *X) Stream(feed chan<- *transitrealtime.FeedMessage) {
+//		provider.StreamBackground(x, feed, nil)
+//	}
+func StreamBackground(
+	p ContextFeedProvider,
+	feed chan<- *transitrealtime.FeedMessage,
+	onError func(err error)) {
+
+	if err := p.StreamContext(context.Background(), feed); err != nil && onError != nil {
+		onError(err)
+	}
+}
+
+func drain(feed <-chan *transitrealtime.FeedMessage) {
+	for range feed {
+	}
+}
+
+type legacyAdapter struct {
+	p FeedProvider
+}
+
+func (a legacyAdapter) StreamContext(
+	ctx context.Context,
+	feed chan<- *transitrealtime.FeedMessage) error {
+
+	defer close(feed)
+
+	inner := make(chan *transitrealtime.FeedMessage)
+
+	go a.p.Stream(inner)
+
+	for {
+		select {
+		case m, ok := <-inner:
+			if !ok {
+				return nil
+			}
+			select {
+			case feed <- m:
+			case <-ctx.Done():
+				go drain(inner)
+				return ctx.Err()
+			}
+		case <-ctx.Done():
+			go drain(inner)
+			return ctx.Err()
+		}
+	}
+}
+
+// AdaptLegacy returns ContextFeedProvider that streams from p. If p already
+// implements ContextFeedProvider it is returned as is.
+//
+// FeedProvider cannot be cancelled, so once ctx is done the returned provider
+// stops forwarding messages and drains p in the background until p closes its
+// channel.
+func AdaptLegacy(p FeedProvider) ContextFeedProvider {
+	if cp, ok := p.(ContextFeedProvider); ok {
+		return cp
+	}
+	return legacyAdapter{p: p}
+}
+
+type contextAdapter struct {
+	ContextFeedProvider
+	onError func(err error)
+}
+
+func (a contextAdapter) Stream(feed chan<- *transitrealtime.FeedMessage) {
+	StreamBackground(a.ContextFeedProvider, feed, a.onError)
+}
+
+// AdaptContext returns FeedProvider that streams from p using
+// context.Background(). The error returned by p, if any, is passed to onError
+// (unless it's nil). The returned value still implements ContextFeedProvider.
+// If p already implements FeedProvider it is returned as is.
+func AdaptContext(p ContextFeedProvider, onError func(err error)) FeedProvider {
+	if fp, ok := p.(FeedProvider); ok {
+		return fp
+	}
+	return contextAdapter{ContextFeedProvider: p, onError: onError}
+}
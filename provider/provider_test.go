@@ -1,17 +1,28 @@
-package provider
+package provider_test
 
 import (
+	"context"
+	"errors"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"testing"
 	"time"
 
 	"github.com/amwolff/google-gtfs-realtime-tools/fetch"
+	transitrealtime "github.com/amwolff/google-gtfs-realtime-tools/gen/go"
+	"github.com/amwolff/google-gtfs-realtime-tools/internal/providertest"
+	"github.com/amwolff/google-gtfs-realtime-tools/provider"
 	"github.com/amwolff/google-gtfs-realtime-tools/provider/dummy"
+	"github.com/stretchr/testify/assert"
 )
 
 func ExampleFeedProvider() {
-	p := dummy.NewDummyProvider(5 * time.Second)
-	defer p.Close()
+	d := dummy.NewDummyProvider(5 * time.Second)
+	defer d.Close()
+
+	var p provider.FeedProvider = d
 
 	h := fetch.NewWithCache(p)
 
@@ -19,3 +30,106 @@ func ExampleFeedProvider() {
 		log.Println(err)
 	}
 }
+
+func ExampleContextFeedProvider() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() { // Stop streaming on interrupt.
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, os.Interrupt)
+		<-c
+		cancel()
+	}()
+
+	var p provider.ContextFeedProvider = dummy.NewDummyProvider(5 * time.Second)
+
+	h := fetch.NewWithCacheContext(ctx, p)
+
+	if err := http.ListenAndServe("localhost:http", h); err != nil {
+		log.Println(err)
+	}
+}
+
+// countingProvider is a FeedProvider that streams n empty messages.
+type countingProvider struct {
+	n int
+}
+
+func (c countingProvider) Stream(feed chan<- *transitrealtime.FeedMessage) {
+	defer close(feed)
+	for i := 0; i < c.n; i++ {
+		feed <- &transitrealtime.FeedMessage{}
+	}
+}
+
+func TestAdaptLegacy(t *testing.T) {
+	p := provider.AdaptLegacy(countingProvider{n: 3})
+
+	feed := make(chan *transitrealtime.FeedMessage)
+	errc := make(chan error, 1)
+	go func() { errc <- p.StreamContext(context.Background(), feed) }()
+	var n int
+	for range feed {
+		n++
+	}
+	assert.Equal(t, 3, n)
+	assert.NoError(t, <-errc)
+
+	// Cancelled stream closes feed even though the legacy provider keeps
+	// streaming.
+	p = provider.AdaptLegacy(countingProvider{n: 1000})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	feed = make(chan *transitrealtime.FeedMessage)
+	go func() { errc <- p.StreamContext(ctx, feed) }()
+	<-feed
+	cancel()
+	for range feed {
+	}
+	assert.Equal(t, context.Canceled, <-errc)
+
+	// Providers that implement ContextFeedProvider are not wrapped.
+	d := dummy.NewDummyProvider(time.Second)
+	assert.Equal(t, d, provider.AdaptLegacy(d))
+}
+
+func TestAdaptContext(t *testing.T) {
+	p := provider.AdaptContext(provider.AdaptLegacy(countingProvider{n: 3}), nil)
+
+	feed := make(chan *transitrealtime.FeedMessage)
+	go p.Stream(feed)
+	var n int
+	for range feed {
+		n++
+	}
+	assert.Equal(t, 3, n)
+
+	_, ok := p.(provider.ContextFeedProvider)
+	assert.True(t, ok)
+
+	// Errors go to onError.
+	errSource := errors.New("source is gone")
+	var reported error
+	p = provider.AdaptContext(
+		struct{ provider.ContextFeedProvider }{providertest.Slice{Err: errSource}},
+		func(err error) { reported = err })
+
+	p.Stream(make(chan *transitrealtime.FeedMessage)) // Nothing to send.
+	assert.Equal(t, errSource, reported)
+}
+
+func TestConsume(t *testing.T) {
+	errSource := errors.New("source is gone")
+	p := providertest.Slice{
+		Messages: []*transitrealtime.FeedMessage{{}, {}, {}},
+		Err:      errSource,
+	}
+
+	var n int
+	err := provider.Consume(context.Background(), p, func(*transitrealtime.FeedMessage) {
+		n++
+	})
+	assert.Equal(t, errSource, err)
+	assert.Equal(t, 3, n)
+}
@@ -0,0 +1,221 @@
+// Package remote contains implementation of the provider.FeedProvider that
+// polls a GTFS-realtime feed published elsewhere, e.g. by a neighbouring
+// agency.
+package remote
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"time"
+
+	transitrealtime "github.com/amwolff/google-gtfs-realtime-tools/gen/go"
+	"github.com/amwolff/google-gtfs-realtime-tools/provider"
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+)
+
+// Poller is an implementation of the provider.FeedProvider and
+// provider.ContextFeedProvider that fetches a feed at a fixed interval and
+// sends the fetched message whenever its header timestamp advances.
+//
+// The response is parsed according to its Content-Type: text/plain as the
+// protocol buffers text format, application/json as the JSON mapping and
+// anything else as the binary format. Gzip-compressed responses (with or
+// without Content-Encoding: gzip) are decompressed. Responses with ETag or
+// Last-Modified headers are revalidated with conditional requests.
+type Poller struct {
+	l        *log.Logger
+	url      string
+	interval time.Duration
+	client   *http.Client
+	header   http.Header
+
+	// Only poll touches these.
+	etag         string
+	lastModified string
+	emitted      bool
+	timestamp    uint64
+}
+
+// Option configures Poller.
+type Option func(*Poller)
+
+// WithClient makes Poller send requests with c instead of
+// http.DefaultClient. It is the place to set timeouts or TLS configuration.
+func WithClient(c *http.Client) Option {
+	return func(p *Poller) {
+		p.client = c
+	}
+}
+
+// WithHeader makes Poller add the header to every request, e.g. to pass an
+// API key or the Authorization header.
+func WithHeader(key, value string) Option {
+	return func(p *Poller) {
+		p.header.Add(key, value)
+	}
+}
+
+// NewPoller returns Poller that fetches url every interval.
+func NewPoller(url string, interval time.Duration, opts ...Option) *Poller {
+	ret := &Poller{
+		l:        log.New(os.Stdout, "Poller", log.LstdFlags),
+		url:      url,
+		interval: interval,
+		client:   http.DefaultClient,
+		header:   make(http.Header),
+	}
+	for _, o := range opts {
+		o(ret)
+	}
+	return ret
+}
+
+func unmarshal(
+	contentType string,
+	b []byte) (*transitrealtime.FeedMessage, error) {
+
+	ret := &transitrealtime.FeedMessage{}
+
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch mediaType {
+	case "text/plain":
+		if err := proto.UnmarshalText(string(b), ret); err != nil {
+			return nil, fmt.Errorf("UnmarshalText: %w", err)
+		}
+	case "application/json":
+		u := jsonpb.Unmarshaler{AllowUnknownFields: true}
+		if err := u.Unmarshal(bytes.NewReader(b), ret); err != nil {
+			return nil, fmt.Errorf("Unmarshal: %w", err)
+		}
+	default:
+		if err := proto.Unmarshal(b, ret); err != nil {
+			return nil, fmt.Errorf("Unmarshal: %w", err)
+		}
+	}
+	return ret, nil
+}
+
+// readBody returns the body of res, decompressing it if necessary.
+func readBody(res *http.Response) ([]byte, error) {
+	br := bufio.NewReader(res.Body)
+	var r io.Reader = br
+
+	// Some feeds are gzipped files served without Content-Encoding.
+	magic, _ := br.Peek(2)
+	if res.Header.Get("Content-Encoding") == "gzip" ||
+		bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("gzip.NewReader: %w", err)
+		}
+		defer zr.Close()
+		r = zr
+	}
+
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("ReadAll: %w", err)
+	}
+	return b, nil
+}
+
+// poll fetches the feed once. It returns nil if the feed hasn't been modified
+// since the last poll.
+func (p *Poller) poll(ctx context.Context) (*transitrealtime.FeedMessage, error) {
+	req, err := http.NewRequest(http.MethodGet, p.url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("NewRequest: %w", err)
+	}
+	req = req.WithContext(ctx)
+
+	for k, v := range p.header {
+		req.Header[k] = v
+	}
+	// Gzip is handled by readBody, which also recognizes gzipped files served
+	// without Content-Encoding.
+	req.Header.Set("Accept-Encoding", "gzip")
+	if p.etag != "" {
+		req.Header.Set("If-None-Match", p.etag)
+	}
+	if p.lastModified != "" {
+		req.Header.Set("If-Modified-Since", p.lastModified)
+	}
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Do: %w", err)
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unexpected status: %s", res.Status)
+	}
+
+	b, err := readBody(res)
+	if err != nil {
+		return nil, fmt.Errorf("readBody: %w", err)
+	}
+	m, err := unmarshal(res.Header.Get("Content-Type"), b)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshal: %w", err)
+	}
+
+	p.etag = res.Header.Get("ETag")
+	p.lastModified = res.Header.Get("Last-Modified")
+
+	return m, nil
+}
+
+func (p *Poller) Stream(feed chan<- *transitrealtime.FeedMessage) {
+	provider.StreamBackground(p, feed, nil)
+}
+
+// StreamContext polls the feed until ctx is done. Failed polls are logged
+// and retried at the next interval. Messages whose header timestamp isn't
+// greater than the one of the last sent message are skipped.
+func (p *Poller) StreamContext(
+	ctx context.Context,
+	feed chan<- *transitrealtime.FeedMessage) error {
+
+	defer close(feed)
+
+	t := time.NewTicker(p.interval)
+	defer t.Stop()
+
+	for {
+		m, err := p.poll(ctx)
+		if err != nil && ctx.Err() == nil {
+			p.l.Printf("poll: %v", err)
+		}
+
+		if ts := m.GetHeader().GetTimestamp(); m != nil && (!p.emitted || ts > p.timestamp) {
+			select {
+			case feed <- m:
+				p.emitted, p.timestamp = true, ts
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
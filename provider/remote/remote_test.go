@@ -0,0 +1,159 @@
+package remote
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	transitrealtime "github.com/amwolff/google-gtfs-realtime-tools/gen/go"
+	"github.com/amwolff/google-gtfs-realtime-tools/internal/providertest"
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+)
+
+func gzipped(b []byte) []byte {
+	buf := &bytes.Buffer{}
+	w := gzip.NewWriter(buf)
+	if _, err := w.Write(b); err != nil {
+		panic(err)
+	}
+	if err := w.Close(); err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+}
+
+// feedServer serves the message it's given with ETag derived from its version.
+type feedServer struct {
+	mu          sync.Mutex
+	m           *transitrealtime.FeedMessage
+	version     int
+	notModified int
+}
+
+func (s *feedServer) set(m *transitrealtime.FeedMessage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.m = m
+	s.version++
+}
+
+func (s *feedServer) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if req.Header.Get("Authorization") != "Bearer secret" {
+		rw.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	etag := fmt.Sprintf(`"%d"`, s.version)
+	if req.Header.Get("If-None-Match") == etag {
+		s.notModified++
+		rw.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	b, err := proto.Marshal(s.m)
+	if err != nil {
+		panic(err)
+	}
+	rw.Header().Set("Content-Type", "application/x-protobuf")
+	rw.Header().Set("Content-Encoding", "gzip")
+	rw.Header().Set("ETag", etag)
+	rw.Write(gzipped(b))
+}
+
+func TestPoller(t *testing.T) {
+	s := &feedServer{}
+	s.set(providertest.NewMessage(1, "1"))
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	p := NewPoller(
+		srv.URL,
+		10*time.Millisecond,
+		WithHeader("Authorization", "Bearer secret"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	feed := make(chan *transitrealtime.FeedMessage)
+	errc := make(chan error, 1)
+	go func() { errc <- p.StreamContext(ctx, feed) }()
+
+	assert.True(t, proto.Equal(providertest.NewMessage(1, "1"), <-feed))
+
+	// Unmodified feed is revalidated rather than fetched.
+	for {
+		s.mu.Lock()
+		n := s.notModified
+		s.mu.Unlock()
+		if n >= 3 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Modified feed whose timestamp hasn't advanced is skipped.
+	m := providertest.NewMessage(1, "1")
+	m.Entity = nil
+	s.set(m)
+	time.Sleep(50 * time.Millisecond)
+
+	s.set(providertest.NewMessage(2, "1"))
+	assert.True(t, proto.Equal(providertest.NewMessage(2, "1"), <-feed))
+
+	cancel()
+	for range feed {
+	}
+	assert.Equal(t, context.Canceled, <-errc)
+}
+
+func TestPoller_poll(t *testing.T) {
+	m := providertest.NewMessage(1, "1")
+
+	binary, err := proto.Marshal(m)
+	if err != nil {
+		panic(err)
+	}
+	json, err := (&jsonpb.Marshaler{}).MarshalToString(m)
+	if err != nil {
+		panic(err)
+	}
+
+	for _, tt := range []struct {
+		name        string
+		contentType string
+		body        []byte
+	}{
+		{"binary", "application/x-protobuf", binary},
+		{"no content type", "", binary},
+		{"text", "text/plain; charset=utf-8", []byte(proto.MarshalTextString(m))},
+		{"json", "application/json", []byte(json)},
+		// A .pb.gz file served as is.
+		{"gzipped file", "application/octet-stream", gzipped(binary)},
+	} {
+		srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			rw.Header().Set("Content-Type", tt.contentType)
+			rw.Write(tt.body)
+		}))
+
+		got, err := NewPoller(srv.URL, time.Second).poll(context.Background())
+		assert.NoError(t, err, tt.name)
+		assert.True(t, proto.Equal(m, got), tt.name)
+
+		srv.Close()
+	}
+
+	srv := httptest.NewServer(&feedServer{})
+	defer srv.Close()
+
+	_, err = NewPoller(srv.URL, time.Second).poll(context.Background())
+	assert.Error(t, err)
+}
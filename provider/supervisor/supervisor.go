@@ -0,0 +1,127 @@
+// Package supervisor contains implementation of the provider.FeedProvider that
+// keeps another provider.FeedProvider running.
+package supervisor
+
+import (
+	"context"
+	"log"
+	"os"
+	"time"
+
+	transitrealtime "github.com/amwolff/google-gtfs-realtime-tools/gen/go"
+	"github.com/amwolff/google-gtfs-realtime-tools/provider"
+)
+
+// Supervisor is an implementation of the provider.FeedProvider and
+// provider.ContextFeedProvider that restarts the supervised
+// provider.FeedProvider whenever it closes its channel. Since
+// Supervisor is a provider.FeedProvider itself it can be used with both fetch
+// and push (oauth.Client.Run) models.
+//
+// The supervised provider must allow calling Stream (or StreamContext if it
+// implements provider.ContextFeedProvider) more than once, although never
+// concurrently.
+type Supervisor struct {
+	l *log.Logger
+	p provider.ContextFeedProvider
+	n int
+
+	minBackoff time.Duration
+	maxBackoff time.Duration
+
+	// OnStart, if not nil, is called before every run of the supervised
+	// provider. Runs are numbered from 0.
+	OnStart func(run int)
+	// OnStop, if not nil, is called after every run of the supervised
+	// provider, i.e. when it has closed its channel, with the error it has
+	// returned.
+	OnStop func(run int, err error)
+}
+
+// NewSupervisor returns Supervisor that restarts p up to n times. If n < 0 it
+// will restart p forever. Consecutive restarts are delayed by exponential
+// backoff that starts at minBackoff and is capped at maxBackoff. The backoff
+// is reset after every run that has streamed at least one message.
+func NewSupervisor(
+	p provider.FeedProvider,
+	n int,
+	minBackoff, maxBackoff time.Duration) *Supervisor {
+
+	return &Supervisor{
+		l:          log.New(os.Stdout, "Supervisor", log.LstdFlags),
+		p:          provider.AdaptLegacy(p),
+		n:          n,
+		minBackoff: minBackoff,
+		maxBackoff: maxBackoff,
+	}
+}
+
+// runOnce streams p onto feed until p closes its channel and returns the
+// number of forwarded messages and the error p has returned.
+func (s *Supervisor) runOnce(
+	ctx context.Context,
+	feed chan<- *transitrealtime.FeedMessage) (int, error) {
+
+	var n int
+	err := provider.Consume(ctx, s.p, func(m *transitrealtime.FeedMessage) {
+		select {
+		case feed <- m:
+			n++
+		case <-ctx.Done():
+		}
+	})
+	return n, err
+}
+
+func (s *Supervisor) Stream(feed chan<- *transitrealtime.FeedMessage) {
+	provider.StreamBackground(s, feed, nil)
+}
+
+// StreamContext streams the supervised provider until ctx is done or the
+// maximum number of restarts has been exceeded. In the latter case it returns
+// the error the supervised provider has returned from its last run.
+func (s *Supervisor) StreamContext(
+	ctx context.Context,
+	feed chan<- *transitrealtime.FeedMessage) error {
+
+	defer close(feed)
+
+	backoff := s.minBackoff
+	for run := 0; ; run++ {
+		if s.OnStart != nil {
+			s.OnStart(run)
+		}
+		n, err := s.runOnce(ctx, feed)
+		if s.OnStop != nil {
+			s.OnStop(run, err)
+		}
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if s.n >= 0 && run >= s.n {
+			s.l.Printf("Giving up after %d restarts", run)
+			return err
+		}
+
+		if n > 0 {
+			backoff = s.minBackoff
+		}
+		s.l.Printf(
+			"Provider stopped after %d messages (err = %v); restarting in %v",
+			n,
+			err,
+			backoff)
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		if backoff *= 2; backoff > s.maxBackoff {
+			backoff = s.maxBackoff
+		}
+	}
+}
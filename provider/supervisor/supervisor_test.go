@@ -0,0 +1,133 @@
+package supervisor
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	transitrealtime "github.com/amwolff/google-gtfs-realtime-tools/gen/go"
+	"github.com/amwolff/google-gtfs-realtime-tools/provider"
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+)
+
+// flakyProvider streams n messages and then closes its channel.
+type flakyProvider struct {
+	mu    sync.Mutex
+	n     int
+	calls int
+}
+
+func (f *flakyProvider) Stream(feed chan<- *transitrealtime.FeedMessage) {
+	defer close(feed)
+
+	f.mu.Lock()
+	f.calls++
+	f.mu.Unlock()
+
+	for i := 0; i < f.n; i++ {
+		feed <- &transitrealtime.FeedMessage{
+			Header: &transitrealtime.FeedHeader{
+				GtfsRealtimeVersion: proto.String("2.0"),
+				Timestamp:           proto.Uint64(uint64(i)),
+			},
+		}
+	}
+}
+
+func TestSupervisor_Stream(t *testing.T) {
+	p := &flakyProvider{n: 2}
+	s := NewSupervisor(p, 3, time.Millisecond, 4*time.Millisecond)
+
+	var starts, stops []int
+	s.OnStart = func(run int) { starts = append(starts, run) }
+	s.OnStop = func(run int, err error) {
+		assert.NoError(t, err)
+		stops = append(stops, run)
+	}
+
+	feed := make(chan *transitrealtime.FeedMessage)
+	go s.Stream(feed)
+
+	var received int
+	for range feed {
+		received++
+	}
+
+	assert.Equal(t, 8, received) // 1 run + 3 restarts, 2 messages each.
+	assert.Equal(t, 4, p.calls)
+	assert.Equal(t, []int{0, 1, 2, 3}, starts)
+	assert.Equal(t, []int{0, 1, 2, 3}, stops)
+}
+
+func TestSupervisor_StreamBackoff(t *testing.T) {
+	p := &flakyProvider{}
+	s := NewSupervisor(p, 4, 10*time.Millisecond, 20*time.Millisecond)
+
+	feed := make(chan *transitrealtime.FeedMessage)
+	start := time.Now()
+	go s.Stream(feed)
+	for range feed {
+	}
+
+	// Backoffs: 10ms, 20ms, 20ms (capped), 20ms.
+	assert.True(t, time.Since(start) >= 70*time.Millisecond)
+	assert.Equal(t, 5, p.calls)
+}
+
+// failingProvider streams a message and fails.
+type failingProvider struct {
+	err error
+}
+
+func (f failingProvider) StreamContext(
+	ctx context.Context,
+	feed chan<- *transitrealtime.FeedMessage) error {
+
+	defer close(feed)
+	select {
+	case feed <- &transitrealtime.FeedMessage{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return f.err
+}
+
+func TestSupervisor_StreamContext(t *testing.T) {
+	errFailing := errors.New("failing")
+
+	s := NewSupervisor(
+		provider.AdaptContext(failingProvider{err: errFailing}, nil),
+		2,
+		time.Millisecond,
+		time.Millisecond)
+
+	var errs []error
+	s.OnStop = func(run int, err error) { errs = append(errs, err) }
+
+	feed := make(chan *transitrealtime.FeedMessage)
+	errc := make(chan error, 1)
+	go func() { errc <- s.StreamContext(context.Background(), feed) }()
+	for range feed {
+	}
+	assert.Equal(t, errFailing, <-errc)
+	assert.Equal(t, []error{errFailing, errFailing, errFailing}, errs)
+
+	// Cancellation stops streaming (even when restarting forever).
+	s = NewSupervisor(
+		provider.AdaptContext(failingProvider{err: errFailing}, nil),
+		-1,
+		time.Hour,
+		time.Hour)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	feed = make(chan *transitrealtime.FeedMessage)
+	go func() { errc <- s.StreamContext(ctx, feed) }()
+	<-feed
+	cancel()
+	for range feed {
+	}
+	assert.Equal(t, context.Canceled, <-errc)
+}